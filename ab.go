@@ -8,19 +8,20 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"mime"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -30,37 +31,29 @@ var (
 	listener         net.Listener
 	graceful         = flag.Bool("graceful", false, "graceful restart")
 	config_file      = flag.String("c", "./config.json", "use config file")
-	conf             *Config
+	conf             atomic.Pointer[Config] //当前配置，重新加载时整体替换，请求开始时取一次快照
 	mylogger         *ZdLogger
-	paramNameVersion = "__abv"
-	paramNameData    = "__abd"
-	sockFile         = "/tmp/abtest.sock"
-	uuid             *ZdUUID
-	bufferSize       = 1024 * 32
 )
 
 var bufferPool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, bufferSize)
+		return make([]byte, conf.Load().Option.BufferSize)
 	},
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" { //配置相关的子命令
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	registerOptionFlags(flag.CommandLine)
 	flag.Parse()
-	conf = NewConfig(*config_file).Parse()
-	mylogger = NewLogger(conf.GetLogDir(), conf.GetLogFormat(), conf.GetLogPrefix())
-	if conf.Default != nil {
-		if v, ok := conf.Default["paramNameVersion"]; ok {
-			paramNameVersion = v.(string)
-		}
-		if v, ok := conf.Default["paramNameData"]; ok {
-			paramNameData = v.(string)
-		}
-		if v, ok := conf.Default["sockFile"]; ok {
-			sockFile = v.(string)
-		}
+	confSource = newConfigSource(*config_file)
+	c, err := loadValidConfig(confSource) //和重新加载一样严格校验，错误带文件:行:列
+	if err != nil {
+		log.Fatalln(err)
 	}
-	uuid = NewUUID()
+	conf.Store(c)
+	mylogger = NewLogger(c.GetLogDir(), c.GetLogFormat(), c.GetLogPrefix())
 	start()
 }
 
@@ -77,15 +70,19 @@ func handleSignal() {
 			log.Println("shutdown")
 			signal.Stop(abSignal)
 			server.SetKeepAlivesEnabled(false)
-			if err := server.Shutdown(ctx); err != nil {
-				mylogger.Println(err)
+			if tlsServer != nil {
+				tlsServer.SetKeepAlivesEnabled(false)
 			}
+			shutdown(ctx)
 			log.Println("graceful shutdown")
 			return
 		case syscall.SIGUSR1: //重新加载配置文件
 			log.Println("reload config file")
-			conf.Parse()
-			mylogger.Println(conf)
+			if err := reloadConfig("signal"); err != nil {
+				log.Println("reload config error:", err)
+				continue
+			}
+			mylogger.Println(conf.Load())
 			continue
 		case syscall.SIGUSR2: // 进程热重启
 			log.Println("reload")
@@ -93,50 +90,90 @@ func handleSignal() {
 			if err != nil {
 				log.Fatalf("graceful reload error: %v", err)
 			}
-			if err := server.Shutdown(ctx); err != nil {
-				mylogger.Println(err)
-			}
+			shutdown(ctx)
 			log.Println("graceful reload")
 			return
 		}
 	}
 }
 
-func reload() error {
-	tl, ok := listener.(*net.TCPListener)
-	if !ok {
-		return errors.New("listener is not tcp listener")
+func shutdown(ctx context.Context) {
+	for _, v := range []*http.Server{server, tlsServer, adminServer} {
+		if v == nil {
+			continue
+		}
+		if err := v.Shutdown(ctx); err != nil {
+			mylogger.Println(err)
+		}
 	}
-	f, err := tl.File()
-	if err != nil {
-		return err
+	events.Close() //没发出去的事件留在spool目录
+}
+
+// 热重启，监听fd从3开始依次传给子进程，名字通过环境变量ABTEST_LISTEN_FDS传递
+func reload() error {
+	names := make([]string, 0, 3)
+	files := make([]*os.File, 0, 3)
+	for _, v := range []struct {
+		name string
+		l    net.Listener
+	}{{"http", listener}, {"https", tlsListener}, {"admin", adminListener}} {
+		if v.l == nil {
+			continue
+		}
+		if ul, ok := v.l.(*net.UnixListener); ok { //socket文件交给子进程，关闭时不能删除
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := listenerFile(v.l)
+		if err != nil {
+			return err
+		}
+		names = append(names, v.name)
+		files = append(files, f)
 	}
 
-	args := []string{"-graceful", "-c=" + *config_file}
+	args := append([]string{"-graceful", "-c=" + *config_file}, optionArgs()...)
 	cmd := exec.Command(os.Args[0], args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), "ABTEST_LISTEN_FDS="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
 	return cmd.Start()
 }
 
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener can not be inherited")
+	}
+	return fl.File()
+}
+
+// 热重启时优先使用父进程传下来的监听，否则新建
+func listen(name, network, addr string) (net.Listener, error) {
+	if *graceful {
+		names := []string{"http"} //兼容只传了http监听的老版本父进程
+		if v := os.Getenv("ABTEST_LISTEN_FDS"); v != "" {
+			names = strings.Split(v, ",")
+		}
+		for i, v := range names {
+			if v == name {
+				return net.FileListener(os.NewFile(uintptr(3+i), name))
+			}
+		}
+	}
+	if network == "unix" { //上次异常退出残留的socket文件
+		os.Remove(addr)
+	}
+	return net.Listen(network, addr)
+}
+
 func start() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/abtest_config_reload", func(writer http.ResponseWriter, request *http.Request) {
-		defer func() {
-			if r := recover(); r != nil {
-				writer.Write([]byte("reload fail"))
-				mylogger.Println(r)
-			}
-		}()
-		conf.Parse()
-		writer.Write([]byte("reload success"))
-	})
 	mux.HandleFunc("/slb_check", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusOK)
 		writer.Write([]byte("ok"))
 	})
-	mux.HandleFunc("/", proxy)
+	mux.HandleFunc("/", route)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -144,27 +181,26 @@ func start() {
 		}
 	}()
 
-	var port int
-	if v, ok := conf.Default["port"]; ok {
-		port = int(v.(float64))
-	}
+	c := conf.Load()
+	option := c.Option
+	port := option.Port
 
 	server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
-		ReadTimeout:  time.Second * 5,
-		WriteTimeout: time.Second * 60,
-		IdleTimeout:  time.Second * 300,
+		ReadTimeout:  option.GetReadTimeout(),
+		WriteTimeout: option.GetWriteTimeout(),
+		IdleTimeout:  option.GetIdleTimeout(),
 		Handler:      mux,
 		// Handler: http.TimeoutHandler(mux, time.Second*60, "TimeOut"),
+		Protocols: new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	if option.H2C { //内网明文HTTP/2，如grpc
+		server.Protocols.SetUnencryptedHTTP2(true)
 	}
 
 	var err error
-	if *graceful {
-		f := os.NewFile(3, "")
-		listener, err = net.FileListener(f)
-	} else {
-		listener, err = net.Listen("tcp", server.Addr)
-	}
+	listener, err = listen("http", "tcp", server.Addr)
 	if err != nil {
 		mylogger.Fatalf("listener error: %v\n", err)
 	}
@@ -181,100 +217,227 @@ func start() {
 		}
 	}()
 
-	ioutil.WriteFile(sockFile, []byte(strconv.Itoa(os.Getpid())), os.ModeAppend)
+	startTLS()
+	startAdmin()
+	startPprof()
+	if option.Watch || isRemoteConfig(c.FilePath) {
+		startWatcher()
+	}
+	if option.Watch {
+		go watchAudiences()
+	}
+	if c.Events != nil { //发送上次没发出去的事件
+		events.Start()
+	}
+
+	os.Chmod(option.SockFile, 0644) //之前的版本创建的文件权限是0000，写不进去
+	ioutil.WriteFile(option.SockFile, []byte(strconv.Itoa(os.Getpid())), 0644)
 
 	log.Printf("Starting httpServer pid:%d, port:%d\n", os.Getpid(), port)
-	go func() {
-		log.Println(http.ListenAndServe(":10000", nil))
-	}()
 	handleSignal()
 	log.Println("Server exited")
 }
 
 func proxy(w http.ResponseWriter, r *http.Request) {
+	c := conf.Load() //整个请求用同一份配置，不受重新加载影响
+
+	//请求id写入每条日志，并传给上游和返回给客户端
+	tmp_uuid, trace, incoming := requestIds(c, r)
+	requestIdHeader := c.Option.RequestIdHeader
+	r.Header.Set(requestIdHeader, tmp_uuid)
+	w.Header().Set(requestIdHeader, tmp_uuid)
+
+	//链路追踪，不采样时spans为nil，下面的调用都不做任何事
+	spans := newRequestTrace(c.Tracing, trace, incoming)
+	r.Header.Set(traceparentHeader, trace.String())
+	root := spans.Start("proxy", spanServer, nil)
+	if incoming && root != nil {
+		root.ParentId = trace.ParentId
+	}
+	defer spans.Export()
+	defer root.Finish()
 	defer func() {
 		if r := recover(); r != nil {
-			mylogger.Println(r)
-			mylogger.Println(string(debug.Stack()))
+			mylogger.Println(tmp_uuid, r)
+			mylogger.Println(tmp_uuid, string(debug.Stack()))
 		}
 	}()
 
-	var __abv, __abd string
-	if tmp, ok := r.Header[paramNameVersion]; ok {
-		__abv = tmp[0]
+	host := ruleHost(c, r)
+	hostLabel := c.MetricHost(host)
+	root.Set("ab.host", host)
+	root.Set("http.request.method", r.Method)
+	root.Set("url.path", r.URL.Path)
+	root.Set("ab.request_id", tmp_uuid)
+	if r.TLS == nil && c.IsForceHttps(host) {
+		redirectHttps(c, w, r)
+		return
 	}
-	if __abv == "" {
-		if tmp, err := r.Cookie(paramNameVersion); err == nil {
-			__abv = tmp.Value
-		}
+
+	parse := spans.Start("parse", spanInternal, root)
+	__abv, __abd := abParams(c, r)
+
+	//保留组优先于所有规则，不信任客户端传来的同名请求头
+	r.Header.Del(holdoutHeader)
+	vid := hostVisitorId(c, w, r, host)
+	holdout := c.HoldoutOf(host, vid)
+	if holdout != "" {
+		r.Header.Set(holdoutHeader, holdout)
+		metrics.Inc("abtest_holdout_total", "host", hostLabel, "scope", holdout, "experiment", "")
 	}
-	if tmp, ok := r.Header[paramNameData]; ok {
-		__abd = tmp[0]
+
+	parse.Finish()
+
+	selectSpan := spans.Start("select", spanInternal, root)
+	ip, group, d := __getIp(c, host, __abv, __abd, clientAddr(c, r), holdout)
+	spans.Record("abd.decode", selectSpan, d.Decode[0], d.Decode[1])
+	setDecisionHeaders(c, r.Header, host, group, d)
+	root.Set("ab.variant", group)
+	root.Set("ab.criterion", d.Criterion)
+	exposure := Event{RequestId: tmp_uuid, Visitor: vid, Host: host, Path: r.URL.Path, Experiment: host}
+	if len(d.Token) > 1 {
+		exposure.Uid = d.Token[1]
 	}
-	if __abd == "" {
-		if tmp, err := r.Cookie(paramNameData); err == nil {
-			__abd = tmp.Value
-		}
+	if exposure.Variant = d.Variant(group); exposure.Variant != "" {
+		events.Exposure(c.Events, exposure)
 	}
 
-	ip := __getIp(r.Host, __abv, __abd)
-	tmp_url := "http://" + ip + r.URL.String()
+	//实验层的分配结果，不信任客户端传来的同名请求头
+	r.Header.Del(experimentsHeader)
+	if rule, ok := c.Rule[host]; ok && holdout == "" && len(rule.Layers) > 0 && c.RuleState(host, time.Now()) == ruleActive {
+		list := assignLayers(rule.Layers, vid)
+		if v := formatAssignments(list); v != "" {
+			r.Header.Set(experimentsHeader, v)
+		}
+		for _, v := range list {
+			exposure.Experiment, exposure.Variant = v.Experiment, v.Variant
+			if v.Holdout {
+				exposure.Variant = criterionHoldout
+			}
+			events.Exposure(c.Events, exposure)
+			if v.Holdout {
+				r.Header.Add(holdoutHeader, holdoutExperiment+":"+v.Experiment)
+				metrics.Inc("abtest_holdout_total", "host", hostLabel, "scope", holdoutExperiment, "experiment", v.Experiment)
+				continue
+			}
+			metrics.Inc("abtest_experiment_assignments_total", "host", hostLabel, "experiment", v.Experiment, "variant", v.Variant)
+		}
+	}
+	upstream, err := c.GetUpstreamURL(host, group, ip)
+	selectSpan.Finish()
+	if err != nil {
+		selectSpan.Fail(err)
+		backendError(w, r, "backend server error0")
+		mylogger.Println(tmp_uuid, err, host, group)
+		return
+	}
+	root.Set("ab.backend", upstream.Host)
+	transport := c.GetTransport(host, group, upstream.Scheme)
+	if upstream.Scheme == "h2c" {
+		upstream.Scheme = "http"
+	}
+	tmp_url := strings.TrimSuffix(upstream.String(), "/") + r.URL.String()
 
-	tmp_uuid := uuid.createUUID()
-	r.Header.Add("AB-REQUEST-ID", tmp_uuid)
-	writeLog(r, tmp_url)
+	writeLog(tmp_uuid, r, tmp_url)
 
-	req, err := http.NewRequest(r.Method, tmp_url, r.Body)
+	// 超时由timer控制，流式响应拿到响应头后不再受限
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.AfterFunc(c.Option.GetUpstreamTimeout(), cancel)
+	defer timer.Stop()
+	req, err := http.NewRequestWithContext(ctx, r.Method, tmp_url, r.Body)
 
 	if err != nil {
 		errStr := tmp_uuid + " backend server error1"
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(errStr))
+		backendError(w, r, errStr)
 		ret, _ := json.Marshal(r.Header)
-		mylogger.Println(ret, errStr)
+		mylogger.Println(errStr, string(ret))
 		return
 	}
 
 	req.Host = r.Host
-	req.URL.Scheme = "http"
-	for _, v := range r.Cookies() {
-		req.AddCookie(v)
-	}
-
-	req.Header = r.Header
-	req.Header.Add("AB-REQUEST-ID", tmp_uuid)
+	req.Trailer = r.Trailer
+	req.Header = upstreamHeader(c, r, host)
 	client := &http.Client{
-		Timeout: time.Second * 60,
+		Transport: transport,
+	}
+	roundTrip := spans.Start("upstream", spanClient, root)
+	defer roundTrip.Finish()
+	if roundTrip != nil { //上游看到的父span是这次转发
+		req.Header.Set(traceparentHeader, spans.Traceparent(roundTrip))
 	}
+	roundTrip.Set("server.address", upstream.Host)
+	roundTrip.Set("url.full", tmp_url)
 	resp, err := client.Do(req)
 
 	if err != nil {
+		roundTrip.Fail(err)
+		root.Fail(err)
 		errStr := tmp_uuid + " backend server error2"
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(errStr))
-		mylogger.Println(err, errStr)
+		backendError(w, r, errStr)
+		mylogger.Println(errStr, err)
+		metrics.Inc("abtest_upstream_errors_total", "host", hostLabel, "group", group)
 		return
 	}
 
-	for k, v := range resp.Header {
-		for _, value := range v {
-			w.Header().Add(k, value)
-		}
-	}
-	for _, cookie := range resp.Cookies() {
-		w.Header().Add("Set-Cookie", cookie.Raw)
+	copyResponseHeader(c, w, resp, host)
+	w.Header().Set(requestIdHeader, tmp_uuid)
+
+	announced := announceTrailer(w, resp)
+
+	flushInterval := responseFlushInterval(c, host, resp)
+	if flushInterval != 0 { //流式响应不受全局WriteTimeout限制
+		timer.Stop()
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
 	}
-	w.Header().Add("AB-REQUEST-ID", tmp_uuid)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-	// buffer := getBuffer()
-	// defer putBuffer(buffer)
-	// io.CopyBuffer(w, resp.Body, buffer)
+	if err := copyResponse(w, resp.Body, flushInterval); err != nil {
+		mylogger.Println(tmp_uuid, "copy response error", err)
+	}
 	resp.Body.Close()
 	r.Body.Close()
+	copyTrailer(w, resp, announced)
+
+	roundTrip.Finish()
+	roundTrip.Set("http.response.status_code", strconv.Itoa(resp.StatusCode))
+	root.Set("http.response.status_code", strconv.Itoa(resp.StatusCode))
+	metrics.Inc("abtest_requests_total", "host", hostLabel, "group", group, "code", strconv.Itoa(resp.StatusCode))
+	if isGrpc(resp.Header) {
+		status := grpcStatus(resp)
+		mylogger.Println(tmp_uuid, "GRPC_STATUS:", status, r.URL.Path)
+		metrics.Inc("abtest_grpc_requests_total", "host", hostLabel, "group", group, "method", c.MetricMethod(host, r.URL.Path), "code", status)
+	}
 }
 
-func writeLog(r *http.Request, url string) {
+// 从请求头或cookie中读取版本号和标识，grpc的metadata就是http2请求头，与普通请求一样读取
+func abParams(c *Config, r *http.Request) (__abv, __abd string) {
+	paramNameVersion, paramNameData := c.Option.ParamNameVersion, c.Option.ParamNameData
+	if tmp, ok := r.Header[paramNameVersion]; ok {
+		__abv = tmp[0]
+	}
+	if __abv == "" {
+		if tmp, err := r.Cookie(paramNameVersion); err == nil {
+			__abv = tmp.Value
+		}
+	}
+	if tmp, ok := r.Header[paramNameData]; ok {
+		__abd = tmp[0]
+	}
+	if __abd == "" {
+		if tmp, err := r.Cookie(paramNameData); err == nil {
+			__abd = tmp.Value
+		}
+	}
+	return
+}
+
+func writeLog(id string, r *http.Request, url string) {
+	if isGrpc(r.Header) { //grpc可能是双向流，不能读取整个请求体
+		ret, _ := json.Marshal(r.Header)
+		mylogger.Println(id, r.Method, r.Host, r.URL, url, fmt.Sprintf("LOG_HEADER: %s", ret))
+		return
+	}
+
 	reqBytes, _ := ioutil.ReadAll(r.Body)
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(reqBytes))
 	ret, _ := json.Marshal(r.Header)
@@ -283,7 +446,7 @@ func writeLog(r *http.Request, url string) {
 	ct, _, _ = mime.ParseMediaType(ct)
 
 	logout := make([]interface{}, 0, 10)
-	logout = append(logout, r.Method, r.Host, r.URL, url, fmt.Sprintf("LOG_HEADER: %s", ret))
+	logout = append(logout, id, r.Method, r.Host, r.URL, url, fmt.Sprintf("LOG_HEADER: %s", ret))
 
 	switch ct {
 	case "application/x-www-form-urlencoded":
@@ -307,12 +470,12 @@ func writeLog(r *http.Request, url string) {
 
 }
 
-func __abdDecode(host, data string) []int64 {
+func __abdDecode(c *Config, host, data string) []int64 {
 	// data := "4a337757333d33232445333d337362704863333d33727c7f672064333d33746252475f74334c"
 
-	var secrets = conf.GetDefaultSecret()
+	var secrets = c.GetDefaultSecret()
 
-	if v, ok := conf.Rule[host]; ok {
+	if v, ok := c.Rule[host]; ok {
 		if v.Secret != nil {
 			secrets = v.Secret
 		}
@@ -320,7 +483,7 @@ func __abdDecode(host, data string) []int64 {
 	if secrets == nil {
 		return nil
 	}
-	c, _ := hex.DecodeString(data)
+	raw, _ := hex.DecodeString(data)
 
 	l := len(secrets)
 	field_num := 4
@@ -340,7 +503,7 @@ func __abdDecode(host, data string) []int64 {
 			} else {
 				ret <- []string{}
 			}
-		}(i, c)
+		}(i, raw)
 	}
 	wg.Wait()
 	close(ret)
@@ -358,64 +521,91 @@ func __abdDecode(host, data string) []int64 {
 	return result
 }
 
-//综合所有条件，得到反向代理目标服务器的ip
-func __getIp(host, abv, __abd string) string {
-	IP_defaultA := conf.GetDefaultARandIp()
+//综合所有条件，得到反向代理目标服务器的ip及其所在分组
+func __getIp(c *Config, host, abv, __abd string, client netip.Addr, holdout string) (string, string, decision) {
+	IP_defaultA := c.GetDefaultARandIp()
 
 	//所有配置都没有
 	var hostParams *ConfigRuleOK
 	var ok bool
-	if hostParams, ok = conf.RuleOK[host]; !ok {
-		return IP_defaultA
+	if hostParams, ok = c.RuleOK[host]; !ok {
+		return IP_defaultA, groupA, decision{Criterion: criterionNoRule}
 	}
 
-	IP_defaultB := conf.GetDefaultBRandIp()
-	if v, ok := conf.Rule[host]; ok {
+	IP_defaultB := c.GetDefaultBRandIp()
+	if v, ok := c.Rule[host]; ok {
 		if v.GroupA != nil {
-			IP_defaultA = conf.GetGroupARandIp(host)
+			IP_defaultA = c.GetGroupARandIp(host)
 		}
 		if v.GroupB != nil {
-			IP_defaultB = conf.GetGroupBRandIp(host)
+			IP_defaultB = c.GetGroupBRandIp(host)
 		}
 	}
 
+	//访客在保留组中，不进入任何实验
+	if holdout != "" {
+		return IP_defaultA, groupA, decision{Criterion: criterionHoldout}
+	}
+
+	//实验暂停，或者不在生效时间内
+	if c.IsPaused(host) {
+		return IP_defaultA, groupA, decision{Criterion: criterionPaused}
+	}
+	if hostParams.Schedule.State(time.Now()) != ruleActive {
+		return IP_defaultA, groupA, decision{Criterion: criterionSchedule}
+	}
+
+	//客户端ip命中，不需要标识
+	if containsAddr(hostParams.ClientIP, client) {
+		return IP_defaultB, groupB, decision{Criterion: criterionClientIP}
+	}
+
 	//所有标识都没有
 	if abv == "" && __abd == "" {
-		return IP_defaultA
+		return IP_defaultA, groupA, decision{Criterion: criterionNone}
 	}
 
 	var abd []int64
+	d := decision{Criterion: criterionNone}
 	//解密标识信息
 	if __abd != "" {
-		abd = __abdDecode(host, __abd)
+		d.Decode[0] = time.Now()
+		abd = __abdDecode(c, host, __abd)
+		d.Decode[1] = time.Now()
 	}
 	abd_len := len(abd)
+	d.Token = abd
 
 	if hostParams.Version.Has(abv) && abd_len == 0 { //只有版本号
-		return IP_defaultB
+		d.Criterion = criterionVersion
+		return IP_defaultB, groupB, d
 	}
 
-	if hostParams.Version.Has(abv) || conf.GetVersions(host) == nil { //命中版本号，或根本没配置版本号
+	if hostParams.Version.Has(abv) || c.GetVersions(host) == nil { //命中版本号，或根本没配置版本号
 		if abd_len > 0 && int64(abd[0]) < time.Now().Unix() { //过期失效
-			return IP_defaultA
+			d.Criterion = criterionExpired
+			return IP_defaultA, groupA, d
 		}
-		if abd_len > 1 && hostParams.Uid.Has(abd[1]) { //用uid判断
-			return IP_defaultB
-		} else if abd_len > 2 && hostParams.Telphone.Has(abd[2]) { //用telphone判断
-			return IP_defaultB
-		} else if abd_len > 3 && hostParams.City.Has(abd[3]) { //用city判断
-			return IP_defaultB
+		if abd_len > 1 && (hostParams.Uid.Has(abd[1]) || hostParams.UidFile.Has(abd[1]) || matchRanges(hostParams.UidRange, abd[1])) { //用uid判断
+			d.Criterion = criterionUid
+			return IP_defaultB, groupB, d
+		} else if abd_len > 2 && (hostParams.Telphone.Has(abd[2]) || hostParams.TelphoneFile.Has(abd[2]) || matchRanges(hostParams.TelphoneRange, abd[2])) { //用telphone判断
+			d.Criterion = criterionTelphone
+			return IP_defaultB, groupB, d
+		} else if abd_len > 3 && (hostParams.City.Has(abd[3]) || hostParams.CityFile.Has(abd[3]) || matchRanges(hostParams.CityRange, abd[3])) { //用city判断
+			d.Criterion = criterionCity
+			return IP_defaultB, groupB, d
 		}
 	}
 
-	return IP_defaultA
+	return IP_defaultA, groupA, d
 }
 
 func getBuffer() []byte {
 	if bf, ok := bufferPool.Get().([]byte); ok {
 		return bf
 	}
-	return make([]byte, bufferSize)
+	return make([]byte, conf.Load().Option.BufferSize)
 }
 
 func putBuffer(bt []byte) {
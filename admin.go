@@ -0,0 +1,534 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	adminServer   *http.Server
+	adminListener net.Listener
+	confMutex     sync.Mutex //串行化对配置的修改
+)
+
+type ConfigAdmin struct {
+	Port     int      `json:"port,omitempty"`
+	Sock     string   `json:"sock,omitempty"`     //unix socket路径，配置后不再监听port
+	Token    string   `json:"token,omitempty"`    //Authorization: Bearer <token>
+	Cert     string   `json:"cert,omitempty"`     //配置后管理接口使用https
+	Key      string   `json:"key,omitempty"`      //
+	ClientCA string   `json:"clientCA,omitempty"` //mTLS，客户端证书由此CA签发即认证通过
+	AllowIPs []string `json:"allowIPs,omitempty"` //ip或cidr，为空不限制，unix socket不受限制
+}
+
+// 启动管理接口(管理api、配置重载、metrics、pprof)，token和mTLS至少配置一种
+func startAdmin() {
+	c := conf.Load().Admin
+	if c == nil || (c.Port <= 0 && c.Sock == "") {
+		return
+	}
+	if c.Token == "" && c.ClientCA == "" {
+		log.Println("admin api disabled: neither token nor clientCA is configured")
+		return
+	}
+	if c.ClientCA != "" && c.Cert == "" {
+		log.Println("admin api disabled: clientCA requires cert and key")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rules", adminListRules)
+	mux.HandleFunc("GET /rules/{host}", adminGetRule)
+	mux.HandleFunc("POST /rules/{host}", adminSaveRule)
+	mux.HandleFunc("PUT /rules/{host}", adminSaveRule)
+	mux.HandleFunc("DELETE /rules/{host}", adminDeleteRule)
+	mux.HandleFunc("POST /rules/{host}/pause", adminPauseRule)
+	mux.HandleFunc("POST /rules/{host}/resume", adminPauseRule)
+	mux.HandleFunc("POST /rules/{host}/{set}", adminUpdateSet)
+	mux.HandleFunc("DELETE /rules/{host}/{set}", adminUpdateSet)
+	mux.HandleFunc("GET /status", adminStatus)
+	mux.HandleFunc("GET /audiences", adminListAudiences)
+	mux.HandleFunc("POST /audiences/reload", adminReloadAudiences)
+	mux.HandleFunc("GET /config/history", adminListHistory)
+	mux.HandleFunc("POST /config/rollback/{id}", adminRollback)
+	mux.HandleFunc("/abtest_config_reload", func(writer http.ResponseWriter, request *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				writer.Write([]byte("reload fail"))
+				mylogger.Println(r)
+			}
+		}()
+		if err := reloadConfig("admin"); err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte("reload fail: " + err.Error()))
+			return
+		}
+		writer.Write([]byte("reload success"))
+	})
+	mux.Handle("/abtest_metrics", metrics)
+	//pprof需要带上token: curl -H "Authorization: Bearer xx" .../debug/pprof/heap > heap.out
+	handlePprof(mux)
+
+	adminServer = &http.Server{
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: 0, //pprof的profile/trace会持续较长时间
+		IdleTimeout:  server.IdleTimeout,
+		Handler:      adminAuth(mux),
+	}
+
+	network, addr := "tcp", fmt.Sprintf(":%d", c.Port)
+	if c.Sock != "" {
+		network, addr = "unix", c.Sock
+	}
+	if c.Cert != "" {
+		tc, err := adminTLSConfig(c)
+		if err != nil {
+			mylogger.Println("admin tls error:", err)
+			return
+		}
+		adminServer.TLSConfig = tc
+	}
+
+	var err error
+	adminListener, err = listen("admin", network, addr)
+	if err != nil {
+		mylogger.Fatalf("admin listener error: %v\n", err)
+		return
+	}
+
+	go func() {
+		var err error
+		if adminServer.TLSConfig != nil {
+			err = adminServer.ServeTLS(adminListener, "", "")
+		} else {
+			err = adminServer.Serve(adminListener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin server closed unexpected(%s)\n", err)
+		}
+	}()
+	log.Printf("Starting adminServer pid:%d, %s:%s\n", os.Getpid(), network, addr)
+}
+
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// 配置了pprofAddr时单独监听pprof，不做认证
+// go tool pprof -http=:8000 http://localhost:10000/debug/pprof/heap
+func startPprof() {
+	addr := conf.Load().Option.PprofAddr
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	handlePprof(mux)
+	go func() {
+		log.Println(http.ListenAndServe(addr, mux))
+	}()
+}
+
+func adminTLSConfig(c *ConfigAdmin) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + c.ClientCA)
+		}
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.Token != "" { //没有客户端证书时还可以用token
+			tc.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tc, nil
+}
+
+// 先检查ip白名单，再检查客户端证书或token
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := conf.Load().Admin
+		if c == nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !adminAllowIP(c, r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || c.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminAllowIP(c *ConfigAdmin, remoteAddr string) bool {
+	if len(c.AllowIPs) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil { //unix socket没有ip，由文件权限控制
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, v := range c.AllowIPs {
+		if !strings.Contains(v, "/") {
+			if allow := net.ParseIP(v); allow != nil && allow.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(v); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// 从配置文件重新加载，失败时保留当前配置
+func reloadConfig(source string) (err error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	defer func() { //任何重新加载的错误都不能让进程退出，保留当前配置
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reload config panic: %v", r)
+			metrics.Inc("abtest_config_reloads_total", "source", source, "result", "failure")
+			mylogger.Println("reload config error:", source, err)
+		}
+	}()
+	next, err := loadValidConfig(confSource)
+	if err != nil {
+		metrics.Inc("abtest_config_reloads_total", "source", source, "result", "failure")
+		mylogger.Println("reload config error:", source, err)
+		return err
+	}
+	prev := conf.Load()
+	if next.Version == prev.Version && source == "watch" { //自己保存或内容没变
+		return nil
+	}
+	for _, v := range next.Diff(prev) {
+		mylogger.Println("reload config:", source, v)
+	}
+	if err := saveHistory(prev, source); err != nil {
+		mylogger.Println("save config history error:", err)
+	}
+	swapConfig(prev, next)
+	metrics.Inc("abtest_config_reloads_total", "source", source, "result", "success")
+	mylogger.Println("reload config success:", source, "version", next.Version)
+	return nil
+}
+
+// 替换当前配置：沿用没变的Transport，释放旧配置中不再使用的连接和人群文件
+func swapConfig(prev, next *Config) {
+	next.reuseTransports(prev)
+	conf.Store(next)
+	prev.closeTransports(next)
+	audiences.Prune(next)
+}
+
+// 严格校验通过后才返回新配置
+func loadValidConfig(source ConfigSource) (*Config, error) {
+	filePath := source.String()
+	files, err := source.Load()
+	if err != nil {
+		return nil, err
+	}
+	if errs := ValidateConfig(files.Data); len(errs) > 0 {
+		msg := make([]string, 0, len(errs))
+		for _, v := range errs {
+			if files.Merged {
+				msg = append(msg, files.Format(v))
+			} else {
+				msg = append(msg, v.Format(filePath, files.Data))
+			}
+		}
+		return nil, errors.New(strings.Join(msg, "; "))
+	}
+	return parseConfig(filePath, files)
+}
+
+// 在配置副本上修改，保存到配置文件成功后再替换当前配置
+func updateConfig(fn func(next *Config) (int, error)) (int, error) {
+	return updateConfigFrom("admin", fn)
+}
+
+func updateConfigFrom(source string, fn func(next *Config) (int, error)) (int, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+
+	prev := conf.Load()
+	if err := prev.adminWritable(); err != nil {
+		return http.StatusForbidden, err
+	}
+	next := prev.Clone()
+	if code, err := fn(next); err != nil {
+		return code, err
+	}
+	if err := CheckConfig(next); err != nil { //校验不通过不写文件，避免之后无法重新加载
+		return http.StatusBadRequest, err
+	}
+	next.buildRules()
+	next.loadAudiences()
+	next.loadCerts()
+	next.loadTransports()
+	if err := next.Save(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if files, err := readConfigFiles(next.FilePath); err == nil { //文件监听据此忽略自己写入引起的变化
+		next.Version = files.Version()
+	}
+	if err := saveHistory(prev, source); err != nil {
+		mylogger.Println("save config history error:", err)
+	}
+	swapConfig(prev, next)
+	mylogger.Println(source, "update config", next)
+	return http.StatusOK, nil
+}
+
+func adminListRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, conf.Load().Rule)
+}
+
+func adminGetRule(w http.ResponseWriter, r *http.Request) {
+	v, ok := conf.Load().Rule[r.PathValue("host")]
+	if !ok {
+		http.Error(w, "rule not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// POST新建，PUT更新已有规则
+func adminSaveRule(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	var rule ConfigRule
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code, err := updateConfig(func(next *Config) (int, error) {
+		_, ok := next.Rule[host]
+		if r.Method == http.MethodPost && ok {
+			return http.StatusConflict, fmt.Errorf("rule %s already exists", host)
+		}
+		if r.Method == http.MethodPut && !ok {
+			return http.StatusNotFound, fmt.Errorf("rule %s not found", host)
+		}
+		if next.Rule == nil {
+			next.Rule = make(map[string]ConfigRule)
+		}
+		next.Rule[host] = rule
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func adminDeleteRule(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	code, err := updateConfig(func(next *Config) (int, error) {
+		if _, ok := next.Rule[host]; !ok {
+			return http.StatusNotFound, fmt.Errorf("rule %s not found", host)
+		}
+		delete(next.Rule, host)
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminPauseRule(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	paused := strings.HasSuffix(r.URL.Path, "/pause")
+	var rule ConfigRule
+	code, err := updateConfig(func(next *Config) (int, error) {
+		var ok bool
+		if rule, ok = next.Rule[host]; !ok {
+			return http.StatusNotFound, fmt.Errorf("rule %s not found", host)
+		}
+		rule.Paused = paused
+		next.Rule[host] = rule
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// POST添加、DELETE删除uids/telphones/citys，请求体为id数组
+func adminUpdateSet(w http.ResponseWriter, r *http.Request) {
+	host, set := r.PathValue("host"), r.PathValue("set")
+	var ids []int64
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rule ConfigRule
+	code, err := updateConfig(func(next *Config) (int, error) {
+		var ok bool
+		if rule, ok = next.Rule[host]; !ok {
+			return http.StatusNotFound, fmt.Errorf("rule %s not found", host)
+		}
+		var items *[]int64
+		switch set {
+		case "uids":
+			items = &rule.Uid
+		case "telphones":
+			items = &rule.Telphone
+		case "citys":
+			items = &rule.City
+		default:
+			return http.StatusNotFound, fmt.Errorf("unknown set %s", set)
+		}
+		current, change := NewSet(*items...), NewSet(ids...)
+		if r.Method == http.MethodDelete {
+			*items = slices.DeleteFunc(*items, change.Has)
+		} else { //新增的id按请求中的顺序追加
+			added := change.Difference(current)
+			for _, id := range ids {
+				if added.Has(id) {
+					*items = append(*items, id)
+					added.Remove(id)
+				}
+			}
+		}
+		next.Rule[host] = rule
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func adminListHistory(w http.ResponseWriter, r *http.Request) {
+	c := conf.Load()
+	list, err := listHistory(historyDir(c.FilePath, c.Option))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// 回滚到历史快照，写回配置文件后替换当前配置，当前配置也会保存为快照
+func adminRollback(w http.ResponseWriter, r *http.Request) {
+	c := conf.Load()
+	snap, err := findHistory(historyDir(c.FilePath, c.Option), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	code, err := updateConfigFrom("rollback", func(next *Config) (int, error) {
+		restored, err := snap.Restore(next.FilePath)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		*next = *restored
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	snap.Config = nil
+	writeJSON(w, http.StatusOK, snap)
+}
+
+var startTime = time.Now()
+
+// 实例状态，多个实例比较version即可知道是否加载了同一份配置
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	c := conf.Load()
+	now := time.Now()
+	rules := make(map[string]interface{}, len(c.Rule))
+	for host := range c.Rule {
+		item := map[string]interface{}{"state": c.RuleState(host, now)}
+		if v, ok := c.RuleOK[host]; ok && v.Schedule != nil {
+			if !v.Schedule.StartAt.IsZero() {
+				item["startAt"] = v.Schedule.StartAt
+			}
+			if !v.Schedule.EndAt.IsZero() {
+				item["endAt"] = v.Schedule.EndAt
+			}
+		}
+		rules[host] = item
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rules":    rules,
+		"pid":      os.Getpid(),
+		"started":  startTime,
+		"source":   c.FilePath,
+		"version":  c.Version,
+		"loadedAt": c.LoadedAt,
+		"hosts":    len(c.Rule),
+	})
+}
+
+func adminListAudiences(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, audiences.Status())
+}
+
+// 只重新加载人群文件，?force=1时不管文件有没有变化都重新读取
+func adminReloadAudiences(w http.ResponseWriter, r *http.Request) {
+	files, err := audiences.Reload(r.URL.Query().Get("force") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 外部人群文件：每行一个id，#开头为注释，可以是gzip压缩的；加载为排序后的int64数组，二分查找
+type Audience struct {
+	File     string
+	ids      atomic.Pointer[[]int64]
+	modTime  time.Time
+	size     int64
+	loadedAt time.Time
+}
+
+// 查询，文件重新加载时整体替换数组，不需要加锁
+func (this *Audience) Has(v int64) bool {
+	if this == nil {
+		return false
+	}
+	ids := this.ids.Load()
+	if ids == nil {
+		return false
+	}
+	_, ok := slices.BinarySearch(*ids, v)
+	return ok
+}
+
+func (this *Audience) Len() int {
+	if ids := this.ids.Load(); ids != nil {
+		return len(*ids)
+	}
+	return 0
+}
+
+// 读取人群文件
+func readAudience(fileName string) ([]int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	ids := make([]int64, 0, 1024)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		id, err := strconv.ParseInt(string(text), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid id %q", fileName, line, text)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// 按文件名共享的人群，配置重新加载时文件没变化就不再读取
+type audienceRegistry struct {
+	*sync.Mutex
+	items map[string]*Audience
+}
+
+var audiences = &audienceRegistry{&sync.Mutex{}, make(map[string]*Audience)}
+
+// 取得人群，第一次使用时加载；已加载的文件有变化时重新读取，出错时保留原来的数据
+func (this *audienceRegistry) Get(fileName string) (*Audience, error) {
+	this.Lock()
+	defer this.Unlock()
+	if v, ok := this.items[fileName]; ok {
+		if _, err := this.load(v, false); err != nil {
+			log.Println("reload audience error:", err)
+		}
+		return v, nil
+	}
+	v := &Audience{File: fileName}
+	if _, err := this.load(v, true); err != nil {
+		return nil, err
+	}
+	this.items[fileName] = v
+	return v, nil
+}
+
+// 重新加载有变化的人群文件，force为true时全部重新读取，返回重新加载了的文件
+func (this *audienceRegistry) Reload(force bool) ([]string, error) {
+	this.Lock()
+	defer this.Unlock()
+	ret := make([]string, 0)
+	var errs []error
+	for _, v := range this.items {
+		changed, err := this.load(v, force)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if changed {
+			ret = append(ret, v.File)
+		}
+	}
+	slices.Sort(ret)
+	if len(errs) > 0 {
+		return ret, fmt.Errorf("%v", errs)
+	}
+	return ret, nil
+}
+
+// 文件大小或修改时间变化时重新读取，出错时保留原来的数据
+func (this *audienceRegistry) load(v *Audience, force bool) (bool, error) {
+	info, err := os.Stat(v.File)
+	if err != nil {
+		metrics.Inc("abtest_audience_reloads_total", "file", v.File, "result", "failure")
+		return false, err
+	}
+	if !force && info.ModTime().Equal(v.modTime) && info.Size() == v.size {
+		return false, nil
+	}
+	ids, err := readAudience(v.File)
+	if err != nil {
+		metrics.Inc("abtest_audience_reloads_total", "file", v.File, "result", "failure")
+		return false, err
+	}
+	v.ids.Store(&ids)
+	v.modTime, v.size, v.loadedAt = info.ModTime(), info.Size(), time.Now()
+	metrics.Inc("abtest_audience_reloads_total", "file", v.File, "result", "success")
+	metrics.Set("abtest_audience_size", int64(len(ids)), "file", v.File)
+	log.Println("load audience:", v.File, len(ids))
+	return true, nil
+}
+
+// 新配置生效后调用，去掉没有规则再引用的人群文件
+func (this *audienceRegistry) Prune(c *Config) {
+	used := make(map[string]bool)
+	for _, v := range c.Rule {
+		for _, name := range []string{v.UidFile, v.TelphoneFile, v.CityFile} {
+			used[name] = true
+		}
+	}
+	this.Lock()
+	defer this.Unlock()
+	for name := range this.items {
+		if !used[name] {
+			delete(this.items, name)
+			metrics.Delete("abtest_audience_size", "file", name)
+			log.Println("unload audience:", name)
+		}
+	}
+}
+
+type audienceStatus struct {
+	File     string    `json:"file"`
+	Size     int       `json:"size"`
+	LoadedAt time.Time `json:"loadedAt"`
+}
+
+func (this *audienceRegistry) Status() []audienceStatus {
+	this.Lock()
+	defer this.Unlock()
+	ret := make([]audienceStatus, 0, len(this.items))
+	for _, v := range this.items {
+		ret = append(ret, audienceStatus{v.File, v.Len(), v.loadedAt})
+	}
+	slices.SortFunc(ret, func(a, b audienceStatus) int {
+		return strings.Compare(a.File, b.File)
+	})
+	return ret
+}
+
+// 开启watch时定期检查人群文件，有变化单独重新加载，不触发整个配置的重新加载
+func watchAudiences() {
+	for {
+		time.Sleep(watchPollInterval)
+		if _, err := audiences.Reload(false); err != nil {
+			mylogger.Println("reload audience error:", err)
+		}
+	}
+}
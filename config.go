@@ -1,44 +1,111 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
-	"os"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	FilePath      string
-	Log           map[string]string      `json:"log"`
-	Default       map[string]interface{} `json:"defaultOption"`
-	DefaultServer map[string][]string    `json:"defaultServer"`
-	DefaultSecret []string               `json:"defaultSecret"`
-	Rule          map[string]ConfigRule  `json:"rule"`
-	RuleOK        map[string]*ConfigRuleOK
+	FilePath         string                      `json:"-"`
+	Schema           string                      `json:"$schema,omitempty"` //编辑器使用的JSON Schema
+	Include          []string                    `json:"include,omitempty"` //rule拆分到其它文件，相对本文件目录的glob，如rules.d/*.yaml
+	Log              map[string]string           `json:"log"`
+	Default          ConfigOption                `json:"defaultOption"`
+	Option           ConfigOption                `json:"-"` //defaultOption叠加默认值、环境变量、命令行参数后实际生效的配置
+	DefaultServer    map[string][]string         `json:"defaultServer"`
+	DefaultSecret    []string                    `json:"defaultSecret"`
+	DefaultUpstream  map[string]*ConfigUpstream  `json:"defaultUpstream,omitempty"`
+	TLS              *ConfigTLS                  `json:"tls,omitempty"`
+	Admin            *ConfigAdmin                `json:"admin,omitempty"`
+	TrustedProxies   []string                    `json:"trustedProxies,omitempty"` //这些地址发来的请求才使用X-Forwarded-For中的客户端ip
+	Holdout          float64                     `json:"holdout,omitempty"`        //保留组百分比，这部分访客不进入任何实验，用于衡量已上线改动的整体效果
+	DecisionHeaders  *ConfigDecisionHeaders      `json:"decisionHeaders,omitempty"`
+	Tracing          *ConfigTracing              `json:"tracing,omitempty"`
+	Events           *ConfigEvents               `json:"events,omitempty"`           //曝光等事件的输出
+	ForwardedHeaders string                      `json:"forwardedHeaders,omitempty"` //转发给上游的代理信息：x-forwarded(默认)、forwarded、both、none
+	Rule             map[string]ConfigRule       `json:"rule"`
+	RuleOK           map[string]*ConfigRuleOK    `json:"-"`
+	TrustedNets      []netip.Prefix              `json:"-"`
+	Certs            map[string]*tls.Certificate `json:"-"` //按不带端口的host索引，""为默认证书
+	Transports       map[string]*hostTransport   `json:"-"` //按"host|分组"索引，host为空的是默认配置
+	Files            []string                    `json:"-"` //主文件及include的文件
+	RuleFile         map[string]string           `json:"-"` //include文件中定义的host -> 文件
+	Version          string                      `json:"-"` //配置内容的摘要，内容不变时不重复加载
+	LoadedAt         time.Time                   `json:"-"`
+}
+
+type ConfigTLS struct {
+	Port int    `json:"port"`
+	Cert string `json:"cert,omitempty"` //SNI没有匹配到host时使用的默认证书
+	Key  string `json:"key,omitempty"`
 }
 
 type ConfigRule struct {
-	Secret   []string `json:"secrets"`
-	Version  []string `json:"versions"`
-	Uid      []int64  `json:"uids"`
-	Telphone []int64  `json:"telphones"`
-	City     []int64  `json:"citys"`
-	Field1   []int64  `json:"field1"`
-	Field2   []int64  `json:"field2"`
-	Field3   []int64  `json:"field3"`
-	GroupA   []string `json:"groupA"`
-	GroupB   []string `json:"groupB"`
+	Secret   []string `json:"secrets,omitempty"`
+	Version  []string `json:"versions,omitempty"`
+	Uid      []int64  `json:"uids,omitempty"`
+	Telphone []int64  `json:"telphones,omitempty"`
+	City     []int64  `json:"citys,omitempty"`
+	Field1   []int64  `json:"field1,omitempty"`
+	Field2   []int64  `json:"field2,omitempty"`
+	Field3   []int64  `json:"field3,omitempty"`
+	GroupA   []string `json:"groupA,omitempty"`
+	GroupB   []string `json:"groupB,omitempty"`
+	//流式响应刷新间隔(毫秒)，-1表示每次写入都立即刷新
+	FlushInterval int64                      `json:"flushInterval,omitempty"`
+	Cert          string                     `json:"cert,omitempty"`
+	Key           string                     `json:"key,omitempty"`
+	ForceHttps    bool                       `json:"forceHttps,omitempty"` //http请求跳转到https
+	Upstream      map[string]*ConfigUpstream `json:"upstream,omitempty"`   //按分组配置上游协议及证书
+	Paused        bool                       `json:"paused,omitempty"`     //暂停实验，所有请求走groupA
+	//外部人群文件，每行一个id，可以gzip压缩，和uids/telphones/citys一起生效
+	UidFile      string `json:"uidFile,omitempty"`
+	TelphoneFile string `json:"telphoneFile,omitempty"`
+	CityFile     string `json:"cityFile,omitempty"`
+	//数值范围及取模分桶，满足任意一个即进入groupB
+	UidRanges      []ConfigRange `json:"uidRanges,omitempty"`
+	TelphoneRanges []ConfigRange `json:"telphoneRanges,omitempty"`
+	CityRanges     []ConfigRange `json:"cityRanges,omitempty"`
+	ClientIPs      []string      `json:"clientIPs,omitempty"` //客户端ip或cidr，命中时不需要标识直接进入groupB，如办公网、测试环境
+	//生效时间，不在时间内所有请求走groupA；时间为RFC3339或按timeZone解析的"2006-01-02 15:04:05"
+	StartAt  string                 `json:"startAt,omitempty"`
+	EndAt    string                 `json:"endAt,omitempty"`
+	Windows  []ConfigWindow         `json:"windows,omitempty"`  //每天生效的时间段
+	TimeZone string                 `json:"timeZone,omitempty"` //如Asia/Shanghai，默认为本机时区
+	Layers   map[string]ConfigLayer `json:"layers,omitempty"`   //实验层，分配结果通过AB-EXPERIMENTS请求头传给后端
+	Holdout  float64                `json:"holdout,omitempty"`  //本实验的保留组百分比，按访客id计算，命中时走groupA
+	Headers  *ConfigHeaderRewrite   `json:"headers,omitempty"`  //改写转发给上游的请求头和返回的响应头
 }
 
 type ConfigRuleOK struct {
-	Version  *SetMap
-	Uid      *SetMap
-	Telphone *SetMap
-	City     *SetMap
-	Field1   *SetMap
-	Field2   *SetMap
-	Field3   *SetMap
+	Version  *Set[string]
+	Uid      *Set[int64]
+	Telphone *Set[int64]
+	City     *Set[int64]
+	Field1   *Set[int64]
+	Field2   *Set[int64]
+	Field3   *Set[int64]
+	//外部人群文件
+	UidFile      *Audience
+	TelphoneFile *Audience
+	CityFile     *Audience
+	//范围条件
+	UidRange      []ConfigRange
+	TelphoneRange []ConfigRange
+	CityRange     []ConfigRange
+	ClientIP      []netip.Prefix
+	Schedule      *ruleSchedule
 }
 
 func NewConfig(filePath string) *Config {
@@ -47,67 +114,236 @@ func NewConfig(filePath string) *Config {
 	}
 }
 
-func (this *Config) Parse() *Config {
-	f, err := os.Open(this.FilePath)
+// 读取并解析配置文件，出错时返回错误，由调用方决定是否退出
+func LoadConfig(filePath string) (*Config, error) {
+	return loadConfigFrom(newConfigSource(filePath))
+}
+
+func loadConfigFrom(source ConfigSource) (*Config, error) {
+	files, err := source.Load()
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	return parseConfig(source.String(), files)
+}
+
+func parseConfig(filePath string, files *configFiles) (*Config, error) {
+	var err error
+	next := NewConfig(filePath)
+	if err := json.Unmarshal(files.Data, next); err != nil {
+		return nil, err
+	}
+	next.Files, next.RuleFile, next.Version = files.Files, files.RuleFile, files.Version()
+	next.LoadedAt = time.Now()
+	if next.Option, err = next.Default.effective(); err != nil {
+		return nil, err
+	}
+	next.buildRules()
+	next.loadAudiences()
+	next.loadCerts()
+	next.loadTransports()
+	return next, nil
+}
+
+// 深拷贝一份配置，用于修改后整体替换，查询用的集合需要重新build
+func (this *Config) Clone() *Config {
+	data, err := json.Marshal(this)
+	if err != nil {
+		panic(err)
+	}
+	next := NewConfig(this.FilePath)
+	if err := json.Unmarshal(data, next); err != nil {
+		panic(err)
+	}
+	next.Option, next.Files, next.RuleFile, next.Version = this.Option, this.Files, this.RuleFile, this.Version
+	next.LoadedAt = this.LoadedAt
+	return next
+}
+
+// 和旧配置比较，返回新增、删除、修改的host及集合大小变化，用于重新加载时记录日志
+func (this *Config) Diff(old *Config) []string {
+	ret := make([]string, 0)
+	for host := range old.Rule {
+		if _, ok := this.Rule[host]; !ok {
+			ret = append(ret, "rule removed: "+host)
+		}
+	}
+	t := reflect.TypeOf(ConfigRule{})
+	for host, rule := range this.Rule {
+		prev, ok := old.Rule[host]
+		if !ok {
+			ret = append(ret, "rule added: "+host)
+			continue
+		}
+		if reflect.DeepEqual(prev, rule) {
+			continue
+		}
+		changes := make([]string, 0)
+		a, b := reflect.ValueOf(prev), reflect.ValueOf(rule)
+		for i := 0; i < t.NumField(); i++ { //字段名和值取自同一个字段，跳过json:"-"的字段不会错位
+			name, ok := jsonName(t.Field(i))
+			if !ok {
+				continue
+			}
+			if a.Field(i).Kind() == reflect.Slice && a.Field(i).Len() != b.Field(i).Len() {
+				changes = append(changes, fmt.Sprintf("%s %d -> %d", name, a.Field(i).Len(), b.Field(i).Len()))
+			}
+		}
+		ret = append(ret, strings.TrimSpace("rule changed: "+host+" "+strings.Join(changes, ", ")))
+	}
+	sort.Strings(ret)
+
+	a, b := *old, *this //rule以外的配置只记录是否有变化
+	a.Rule, b.Rule = nil, nil
+	dataA, _ := json.Marshal(&a)
+	dataB, _ := json.Marshal(&b)
+	if !bytes.Equal(dataA, dataB) {
+		ret = append(ret, "settings changed")
 	}
-	defer f.Close()
-	if err := json.NewDecoder(f).Decode(this); err != nil {
-		log.Fatalln(err)
+	return ret
+}
+
+// 管理接口能否改写配置文件：远程配置只读；yaml/toml重新生成会丢掉注释和key的顺序，只能手工修改后重新加载
+func (this *Config) adminWritable() error {
+	if isRemoteConfig(this.FilePath) {
+		return errors.New("config from " + this.FilePath + " is read-only")
+	}
+	for _, v := range this.Files {
+		switch strings.ToLower(filepath.Ext(v)) {
+		case ".yaml", ".yml", ".toml":
+			return fmt.Errorf("%s: admin changes are not written to YAML/TOML files, which would lose comments and key order; edit the file and reload", v)
+		}
+	}
+	return nil
+}
+
+// 把配置原子地写回配置文件，有include或不是json时按原来的文件和格式拆分保存
+func (this *Config) Save() error {
+	if isRemoteConfig(this.FilePath) {
+		return errors.New("config from " + this.FilePath + " is read-only")
 	}
+	ext := strings.ToLower(filepath.Ext(this.FilePath))
+	if len(this.Files) > 1 || (ext != ".json" && ext != "") {
+		return this.saveFiles()
+	}
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(this.FilePath, append(data, '\n'), 0644)
+}
+
+// 根据Rule生成查询用的集合
+func (this *Config) buildRules() {
 	if this.RuleOK == nil {
 		this.RuleOK = make(map[string]*ConfigRuleOK)
 	}
 	if this.Rule != nil {
 		for k, v := range this.Rule {
-			tmp := &ConfigRuleOK{}
-			tmp.Version = NewSet()
-			if v.Version != nil {
-				for _, v1 := range v.Version {
-					tmp.Version.Add(v1)
-				}
-			}
-			tmp.Uid = NewSet()
-			if v.Uid != nil {
-				for _, v1 := range v.Uid {
-					tmp.Uid.Add(v1)
-				}
-			}
-			tmp.Telphone = NewSet()
-			if v.Telphone != nil {
-				for _, v1 := range v.Telphone {
-					tmp.Telphone.Add(v1)
-				}
-			}
-			tmp.City = NewSet()
-			if v.City != nil {
-				for _, v1 := range v.City {
-					tmp.City.Add(v1)
-				}
-			}
-			tmp.Field1 = NewSet()
-			if v.Field1 != nil {
-				for _, v1 := range v.Field1 {
-					tmp.Field1.Add(v1)
-				}
+			tmp := &ConfigRuleOK{
+				Version:  NewSet(v.Version...),
+				Uid:      NewSet(v.Uid...),
+				Telphone: NewSet(v.Telphone...),
+				City:     NewSet(v.City...),
+				Field1:   NewSet(v.Field1...),
+				Field2:   NewSet(v.Field2...),
+				Field3:   NewSet(v.Field3...),
+
+				UidRange:      v.UidRanges,
+				TelphoneRange: v.TelphoneRanges,
+				CityRange:     v.CityRanges,
 			}
-			tmp.Field2 = NewSet()
-			if v.Field2 != nil {
-				for _, v1 := range v.Field2 {
-					tmp.Field2.Add(v1)
-				}
+			this.RuleOK[k] = tmp
+		}
+	}
+	this.buildNets()
+	this.buildSchedules()
+}
+
+// 加载人群文件，文件没变化时复用已加载的数据，出错时只记录日志
+func (this *Config) loadAudiences() {
+	for k, v := range this.Rule {
+		tmp := this.RuleOK[k]
+		for _, item := range []struct {
+			file string
+			dst  **Audience
+		}{{v.UidFile, &tmp.UidFile}, {v.TelphoneFile, &tmp.TelphoneFile}, {v.CityFile, &tmp.CityFile}} {
+			if item.file == "" {
+				continue
 			}
-			tmp.Field3 = NewSet()
-			if v.Field3 != nil {
-				for _, v1 := range v.Field3 {
-					tmp.Field3.Add(v1)
-				}
+			audience, err := audiences.Get(item.file)
+			if err != nil {
+				log.Println("load audience error:", k, err)
+				continue
 			}
-			this.RuleOK[k] = tmp
+			*item.dst = audience
+		}
+	}
+}
+
+// 加载https证书，单个证书出错时只记录日志，不影响其它host
+func (this *Config) loadCerts() {
+	certs := make(map[string]*tls.Certificate)
+	if this.TLS != nil && this.TLS.Cert != "" {
+		if cert, err := tls.LoadX509KeyPair(this.TLS.Cert, this.TLS.Key); err == nil {
+			certs[""] = &cert
+		} else {
+			log.Println("load default cert error:", err)
+		}
+	}
+	for k, v := range this.Rule {
+		if v.Cert == "" {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(v.Cert, v.Key)
+		if err != nil {
+			log.Println("load cert error:", k, err)
+			continue
+		}
+		certs[strings.ToLower(stripPort(k))] = &cert
+	}
+	this.Certs = certs
+}
+
+// 按SNI选择证书，供tls.Config.GetCertificate使用
+func (this *Config) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := this.Certs
+	if cert, ok := certs[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	if cert, ok := certs[""]; ok {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+func (this *Config) GetTLSPort() (ret int) {
+	if this.TLS != nil {
+		ret = this.TLS.Port
+	}
+	return
+}
+
+func (this *Config) IsPaused(host string) (ret bool) {
+	if this.Rule != nil {
+		if v, ok := this.Rule[host]; ok {
+			ret = v.Paused
 		}
 	}
-	return this
+	return
+}
+
+// 开启了https监听并且host配置了跳转
+func (this *Config) IsForceHttps(host string) (ret bool) {
+	if this.GetTLSPort() <= 0 {
+		return
+	}
+	if this.Rule != nil {
+		if v, ok := this.Rule[host]; ok {
+			ret = v.ForceHttps
+		}
+	}
+	return
 }
 
 func (this *Config) GetLogDir() (ret string) {
@@ -234,6 +470,20 @@ func (this *Config) GetGroupB(host string) (ret []string) {
 	return
 }
 
+// 流式响应刷新间隔，host未配置时使用defaultOption.flushInterval
+func (this *Config) GetFlushInterval(host string) time.Duration {
+	ms := this.Option.FlushInterval
+	if this.Rule != nil {
+		if v, ok := this.Rule[host]; ok && v.FlushInterval != 0 {
+			ms = v.FlushInterval
+		}
+	}
+	if ms < 0 {
+		return -1
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 func (this *Config) GetDefaultARandIp() (ret string) {
 	ips := this.GetDefaultServerGroupA()
 	if ips != nil {
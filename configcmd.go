@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const configUsage = `usage: abtest config <command> [flags]
+
+commands:
+  validate -c file    strictly check a config file (json, yaml or toml, with its includes)
+  schema              print the JSON Schema of the config file
+  serve -c file -addr :8090
+                      serve the config over http (with ETag) for instances started with -c http://...
+  history -c file     list saved snapshots of the config, newest first
+  rollback -c file id restore a snapshot (id, id prefix or version) and reload the running instance
+`
+
+// 配置相关的子命令，返回进程退出码
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	switch args[0] {
+	case "validate":
+		return configValidate(args[1:])
+	case "schema":
+		return configSchema()
+	case "serve":
+		return configServe(args[1:])
+	case "history":
+		return configHistory(args[1:])
+	case "rollback":
+		return configRollback(args[1:])
+	}
+	fmt.Fprint(os.Stderr, configUsage)
+	return 2
+}
+
+func configValidate(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	fileName := fs.String("c", "./config.json", "config file to validate")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	files, err := newConfigSource(*fileName).Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	errs := ValidateConfig(files.Data)
+	for _, v := range errs {
+		if files.Merged {
+			fmt.Println(files.Format(v))
+		} else {
+			fmt.Println(v.Format(*fileName, files.Data))
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d error(s)\n", *fileName, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *fileName)
+	return 0
+}
+
+func configSchema() int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ConfigSchema()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// 配置有错误时也要能查看和回滚历史，只取defaultOption
+func commandOption(fileName string) ConfigOption {
+	var c struct {
+		Default ConfigOption `json:"defaultOption"`
+	}
+	if files, err := readConfigFiles(fileName); err == nil {
+		json.Unmarshal(files.Data, &c)
+	}
+	option, err := c.Default.effective()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return option
+}
+
+func configHistory(args []string) int {
+	fs := flag.NewFlagSet("config history", flag.ContinueOnError)
+	fileName := fs.String("c", "./config.json", "config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	list, err := listHistory(historyDir(*fileName, commandOption(*fileName)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tSOURCE\tHOSTS")
+	for _, v := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", v.Id, v.Time.Format(time.DateTime), v.Source, v.Hosts)
+	}
+	w.Flush()
+	return 0
+}
+
+func configRollback(args []string) int {
+	fs := flag.NewFlagSet("config rollback", flag.ContinueOnError)
+	fileName := fs.String("c", "./config.json", "config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	option := commandOption(*fileName)
+	snap, err := findHistory(historyDir(*fileName, option), fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	next, err := snap.Restore(*fileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cur, err := LoadConfig(*fileName); err == nil { //当前配置也留一份，回滚错了还能再回来
+		if err := saveHistory(cur, "rollback"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if err := next.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: rolled back to %s\n", *fileName, snap.Id)
+
+	//通知正在运行的进程重新加载，通知不到时文件已经改了，但进程还在用旧配置
+	data, err := os.ReadFile(option.SockFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reload not signaled:", err)
+		return 1
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reload not signaled: invalid pid file %s: %v\n", option.SockFile, err)
+		return 1
+	}
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		err = p.Signal(syscall.SIGUSR1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reload not signaled: pid %d: %v\n", pid, err)
+		return 1
+	}
+	fmt.Printf("sent SIGUSR1 to pid %d\n", pid)
+	return 0
+}
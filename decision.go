@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分流依据
+const (
+	criterionNone     = "none" //没有命中任何条件
+	criterionNoRule   = "noRule"
+	criterionHoldout  = "holdout"
+	criterionPaused   = "paused"
+	criterionSchedule = "schedule" //不在生效时间内
+	criterionClientIP = "clientIP"
+	criterionExpired  = "expired" //标识已过期
+	criterionVersion  = "version"
+	criterionUid      = "uid"
+	criterionTelphone = "telphone"
+	criterionCity     = "city"
+)
+
+// 标识解密后各字段的名称，依次为过期时间、uid、手机号、城市
+var tokenFields = []string{"expire", "uid", "telphone", "city", "field1", "field2", "field3"}
+
+// 分流结果传给后端的请求头，名称为空的不传
+type ConfigDecisionHeaders struct {
+	Variant    string `json:"variant,omitempty"`    //分组，groupA或groupB，如AB-VARIANT
+	Experiment string `json:"experiment,omitempty"` //实验，即rule的host
+	Criterion  string `json:"criterion,omitempty"`  //命中的条件：version、uid、telphone、city、clientIP，或没有进入实验的原因
+	Token      string `json:"token,omitempty"`      //解密后的标识，如expire=1767225600;uid=123;telphone=0;city=0
+}
+
+// __getIp的分流依据
+type decision struct {
+	Criterion string
+	Token     []int64
+	Decode    [2]time.Time //解密标识的起止时间，用于链路追踪
+}
+
+// 记录事件时的分组：保留组为holdout，没有规则、暂停或不在生效时间内的不算进入实验，返回""
+func (this decision) Variant(group string) string {
+	switch this.Criterion {
+	case criterionHoldout:
+		return criterionHoldout
+	case criterionNoRule, criterionPaused, criterionSchedule:
+		return ""
+	}
+	return group
+}
+
+func (this *ConfigDecisionHeaders) names() []string {
+	if this == nil {
+		return nil
+	}
+	return []string{this.Variant, this.Experiment, this.Criterion, this.Token}
+}
+
+func formatToken(token []int64) string {
+	items := make([]string, 0, len(token))
+	for i, v := range token {
+		if i >= len(tokenFields) {
+			break
+		}
+		items = append(items, tokenFields[i]+"="+strconv.FormatInt(v, 10))
+	}
+	return strings.Join(items, ";")
+}
+
+// 去掉客户端传来的同名请求头，防止伪造，再写入本次的分流结果
+func setDecisionHeaders(c *Config, header http.Header, host, group string, d decision) {
+	h := c.DecisionHeaders
+	if h == nil {
+		return
+	}
+	for _, name := range h.names() {
+		if name != "" {
+			header.Del(name)
+		}
+	}
+	set := func(name, value string) {
+		if name != "" && value != "" {
+			header.Set(name, value)
+		}
+	}
+	set(h.Variant, group)
+	if _, ok := c.Rule[host]; ok {
+		set(h.Experiment, host)
+	}
+	set(h.Criterion, d.Criterion)
+	set(h.Token, formatToken(d.Token))
+}
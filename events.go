@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 曝光等事件的输出，每个事件一行json，先按批写入spool目录，发送成功后再删除，保证至少一次
+type ConfigEvents struct {
+	Output        string            `json:"output"`                  //file、http或stdout
+	File          string            `json:"file,omitempty"`          //output为file时追加写入的文件
+	URL           string            `json:"url,omitempty"`           //output为http时POST的地址，请求体为NDJSON
+	Headers       map[string]string `json:"headers,omitempty"`       //output为http时附加的请求头
+	BatchSize     int               `json:"batchSize,omitempty"`     //默认100
+	FlushInterval int64             `json:"flushInterval,omitempty"` //毫秒，默认1000
+	SpoolDir      string            `json:"spoolDir,omitempty"`      //默认为日志目录下的events_spool
+	Dedup         int64             `json:"dedup,omitempty"`         //秒，同一访客同一实验在这段时间内只记录一次曝光，0为不去重
+	TrackPath     string            `json:"trackPath,omitempty"`     //转化上报的路径，默认/abtest/track，由代理处理，后端同名路径不再可访问
+}
+
+const (
+	eventOutputFile   = "file"
+	eventOutputHTTP   = "http"
+	eventOutputStdout = "stdout"
+)
+
+const (
+	eventQueueSize     = 8192
+	eventRetryInterval = 10 * time.Second
+	eventDedupLimit    = 1000000 //去重记录的上限，超过后清空，最多多记录一次
+)
+
+// 一条事件，曝光和转化共用
+type Event struct {
+	Type       string  `json:"type"` //exposure或conversion
+	Time       string  `json:"time"`
+	RequestId  string  `json:"requestId,omitempty"`
+	Visitor    string  `json:"visitor,omitempty"`
+	Uid        int64   `json:"uid,omitempty"`
+	Host       string  `json:"host"`
+	Path       string  `json:"path,omitempty"`
+	Experiment string  `json:"experiment"`
+	Variant    string  `json:"variant"`
+	Goal       string  `json:"goal,omitempty"`
+	Value      float64 `json:"value,omitempty"`
+}
+
+type eventSink struct {
+	once   sync.Once
+	queue  chan []byte
+	done   chan chan struct{}
+	kick   chan struct{} //有新写入spool的批，通知发送
+	dedup  *eventDedup
+	client *http.Client
+}
+
+var events = &eventSink{
+	queue:  make(chan []byte, eventQueueSize),
+	done:   make(chan chan struct{}),
+	kick:   make(chan struct{}, 1),
+	dedup:  &eventDedup{seen: make(map[string]int64)},
+	client: &http.Client{Timeout: 10 * time.Second},
+}
+
+// 同一访客同一实验的曝光去重
+type eventDedup struct {
+	sync.Mutex
+	seen map[string]int64 //key -> 过期时间
+}
+
+func (this *eventDedup) First(key string, ttl int64) bool {
+	if ttl <= 0 {
+		return true
+	}
+	now := time.Now().Unix()
+	this.Lock()
+	defer this.Unlock()
+	if exp, ok := this.seen[key]; ok && exp > now {
+		return false
+	}
+	if len(this.seen) >= eventDedupLimit {
+		for k, exp := range this.seen {
+			if exp <= now {
+				delete(this.seen, k)
+			}
+		}
+		if len(this.seen) >= eventDedupLimit {
+			this.seen = make(map[string]int64)
+		}
+	}
+	this.seen[key] = now + ttl
+	return true
+}
+
+// 记录一次曝光，按配置去重
+func (this *eventSink) Exposure(c *ConfigEvents, e Event) {
+	if c == nil {
+		return
+	}
+	e.Type = "exposure"
+	id := e.Visitor
+	if id == "" {
+		id = strconv.FormatInt(e.Uid, 10)
+	}
+	if !this.dedup.First(id+"\x00"+e.Host+"\x00"+e.Experiment, c.Dedup) { //分组变化(如暂停)不算新的曝光
+		metrics.Inc("abtest_events_total", "type", e.Type, "result", "dedup")
+		return
+	}
+	this.Emit(c, e)
+}
+
+// 事件放入队列，队列满时丢弃并计数
+func (this *eventSink) Emit(c *ConfigEvents, e Event) {
+	if c == nil {
+		return
+	}
+	this.Start()
+	if e.Time == "" {
+		e.Time = time.Now().Format(time.RFC3339Nano)
+	}
+	line, _ := json.Marshal(e)
+	select {
+	case this.queue <- line:
+		metrics.Inc("abtest_events_total", "type", e.Type, "result", "queued")
+	default:
+		metrics.Inc("abtest_events_total", "type", e.Type, "result", "dropped")
+	}
+}
+
+// 退出前把队列中的事件写入spool目录，下次启动(或热重启后的新进程)再发送
+func (this *eventSink) Close() {
+	if conf.Load().Events == nil {
+		return
+	}
+	this.Start()
+	ch := make(chan struct{})
+	this.done <- ch
+	<-ch
+}
+
+func (this *eventSink) Start() {
+	this.once.Do(func() {
+		go this.run()
+		go this.deliverLoop()
+	})
+}
+
+// 攒够一批或到了flushInterval写入spool，发送在deliverLoop中进行，下游不可用时队列仍然不断写入磁盘
+func (this *eventSink) run() {
+	batch := make([][]byte, 0, 100)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		c := conf.Load().Events
+		size, interval := 100, time.Second
+		if c != nil && c.BatchSize > 0 {
+			size = c.BatchSize
+		}
+		if c != nil && c.FlushInterval > 0 {
+			interval = time.Duration(c.FlushInterval) * time.Millisecond
+		}
+		var done chan struct{}
+		select {
+		case line := <-this.queue:
+			batch = append(batch, line)
+			if len(batch) < size {
+				continue
+			}
+		case done = <-this.done:
+			for len(this.queue) > 0 {
+				batch = append(batch, <-this.queue)
+			}
+		case <-ticker.C:
+			if time.Since(last) < interval {
+				continue
+			}
+		}
+		if len(batch) > 0 {
+			if err := this.spool(batch); err != nil {
+				mylogger.Println("spool events error:", err)
+			}
+			batch = batch[:0]
+			select {
+			case this.kick <- struct{}{}:
+			default:
+			}
+		}
+		last = time.Now()
+		if done != nil { //退出时只写入spool，不等待发送
+			close(done)
+		}
+	}
+}
+
+// 有新批时发送spool目录中的文件；发送失败后每eventRetryInterval重试一次
+func (this *eventSink) deliverLoop() {
+	ticker := time.NewTicker(eventRetryInterval)
+	defer ticker.Stop()
+	failing, lastRetry := this.deliver() != nil, time.Now() //启动时先发送上次留下的
+	for {
+		select {
+		case <-this.kick:
+			if failing && time.Since(lastRetry) < eventRetryInterval {
+				continue
+			}
+		case <-ticker.C:
+		}
+		lastRetry = time.Now()
+		failing = this.deliver() != nil
+	}
+}
+
+func (this *eventSink) spoolDir() string {
+	c := conf.Load()
+	if c.Events != nil && c.Events.SpoolDir != "" {
+		return c.Events.SpoolDir
+	}
+	return filepath.Join(c.GetLogDir(), "events_spool")
+}
+
+// 一批事件先写入临时文件再改名，发送时只读取完整的批
+func (this *eventSink) spool(batch [][]byte) error {
+	dir := this.spoolDir()
+	if err := os.MkdirAll(dir, 0700); err != nil { //事件中有访客id和uid
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil { //之前的版本创建的目录是0755
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%d-%d.ndjson", time.Now().UnixNano(), os.Getpid()))
+	data := append(bytes.Join(batch, []byte("\n")), '\n')
+	if err := os.WriteFile(name+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// 按时间顺序发送spool目录中的批，失败时保留文件，等下次重试
+func (this *eventSink) deliver() error {
+	c := conf.Load().Events
+	if c == nil {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(this.spoolDir(), "*.ndjson"))
+	sort.Strings(files)
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if err := this.write(c, data); err != nil {
+			mylogger.Println("deliver events error:", name, err)
+			metrics.Inc("abtest_event_batches_total", "result", "failure")
+			return err
+		}
+		os.Remove(name)
+		metrics.Inc("abtest_event_batches_total", "result", "success")
+	}
+	return nil
+}
+
+func (this *eventSink) write(c *ConfigEvents, data []byte) error {
+	switch c.Output {
+	case eventOutputFile:
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case eventOutputStdout:
+		_, err := os.Stdout.Write(data)
+		return err
+	case eventOutputHTTP:
+		req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := this.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s: %s", c.URL, resp.Status)
+		}
+		return nil
+	}
+	return errors.New("unknown events output: " + c.Output)
+}
+
+func checkEvents(c *ConfigEvents) []string {
+	errs := make([]string, 0)
+	switch c.Output {
+	case eventOutputFile:
+		if c.File == "" {
+			errs = append(errs, "file is required for file output")
+		}
+	case eventOutputHTTP:
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			errs = append(errs, "url must be an http(s) url for http output")
+		}
+	case eventOutputStdout:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown output %q, expect file, http or stdout", c.Output))
+	}
+	if c.BatchSize < 0 || c.FlushInterval < 0 || c.Dedup < 0 {
+		errs = append(errs, "batchSize, flushInterval and dedup must not be negative")
+	}
+	if c.TrackPath != "" && !strings.HasPrefix(c.TrackPath, "/") {
+		errs = append(errs, fmt.Sprintf("trackPath %q must start with /", c.TrackPath))
+	}
+	return errs
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 配置项在源文件中的位置
+type configPos struct {
+	File string
+	Line int
+	Col  int
+}
+
+// 配置项的路径，逐级的key和数组下标以\x00连接，和格式无关
+func configKey(path, key string) string {
+	return path + "\x00" + key
+}
+
+// 按扩展名解析配置文件：.yaml/.yml、.toml，其余按json，同时返回各配置项的行列；解析器的panic转为错误，不能因为一次错误的修改让进程退出
+func decodeConfigFile(fileName string, data []byte) (ret map[string]interface{}, pos map[string]configPos, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ret, pos, err = nil, nil, fmt.Errorf("%s: parse error: %v", fileName, r)
+		}
+	}()
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		ret, pos, err = parseYAMLPositions(data)
+	case ".toml":
+		ret, pos, err = parseTOMLPositions(data)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber() //uid等int64不能经过float64
+		if err = dec.Decode(&ret); err == nil {
+			pos = make(map[string]configPos)
+			walkJSON(data, func(path string, off int64) {
+				line := bytes.Count(data[:off], []byte("\n")) + 1
+				pos[path] = configPos{Line: line, Col: int(off) - bytes.LastIndexByte(data[:off], '\n')}
+			})
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	for k, v := range pos {
+		v.File = fileName
+		pos[k] = v
+	}
+	return ret, pos, nil
+}
+
+// 遍历json中的每个key和数组元素，off和校验时记录的位置一致：读完key或元素的第一个token之后
+func walkJSON(data []byte, fn func(path string, off int64)) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var walk func(path string, item bool) error
+	walk = func(path string, item bool) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if item {
+			fn(path, dec.InputOffset())
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				sub := configKey(path, key.(string))
+				fn(sub, dec.InputOffset())
+				if err := walk(sub, false); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(configKey(path, strconv.Itoa(i)), true); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	return walk("", true)
+}
+
+func encodeConfigFile(fileName string, v map[string]interface{}) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return encodeYAML(v), nil
+	case ".toml":
+		return encodeTOML(v), nil
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	return append(data, '\n'), err
+}
+
+// 读取到的配置文件，include的文件合并到主文件中
+type configFiles struct {
+	Data     []byte            //合并后的json
+	Files    []string          //主文件及include的文件
+	RuleFile map[string]string //include文件中定义的host -> 文件
+	Merged   bool              //Data由解析后重新生成，不是原文件内容
+	Include  []string          //include的glob，已按主文件目录展开
+
+	Pos  map[string]configPos //Merged时各配置项在原文件中的位置
+	keys map[int64]string     //Data中的位置 -> 配置项路径
+}
+
+// 合并后的配置按错误在Data中的位置找到配置项，再找到它(或最近的上级)在原文件中的行列
+func (this *configFiles) Format(e ConfigError) string {
+	if this.keys == nil {
+		this.keys = make(map[int64]string)
+		walkJSON(this.Data, func(path string, off int64) {
+			this.keys[off] = path
+		})
+	}
+	if path, ok := this.keys[e.Offset]; ok {
+		for {
+			if p, ok := this.Pos[path]; ok {
+				return e.format(p)
+			}
+			i := strings.LastIndexByte(path, 0)
+			if i < 0 {
+				break
+			}
+			path = path[:i]
+		}
+	}
+
+	fileName := this.Files[0]
+	if strings.HasPrefix(e.Path, "rule[") {
+		host, _, _ := strings.Cut(strings.TrimPrefix(e.Path, "rule["), "]")
+		if v, err := strconv.Unquote(host); err == nil && this.RuleFile[v] != "" {
+			fileName = this.RuleFile[v]
+		}
+	}
+	return e.format(configPos{File: fileName, Line: 1, Col: 1})
+}
+
+// 合并后内容的摘要，作为配置版本
+func (this *configFiles) Version() string {
+	sum := sha256.Sum256(this.Data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// 读取主配置文件，include按相对主文件目录的glob展开，被include的文件只能定义rule
+func readConfigFiles(filePath string) (*configFiles, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	ret := &configFiles{
+		Data:     data,
+		Files:    []string{filePath},
+		RuleFile: make(map[string]string),
+	}
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if (ext == ".json" || ext == "") && !bytes.Contains(data, []byte(`"include"`)) { //普通json保持原样，校验时行号才准确
+		return ret, nil
+	}
+
+	ret.Merged = true
+	main, pos, err := decodeConfigFile(filePath, data)
+	if err != nil {
+		return nil, err
+	}
+	ret.Pos = pos
+	patterns, includes, err := configIncludes(filePath, main["include"])
+	if err != nil {
+		return nil, err
+	}
+	if patterns != nil {
+		main["include"] = patterns
+	}
+	for _, v := range patterns {
+		if !filepath.IsAbs(v) {
+			v = filepath.Join(filepath.Dir(filePath), v)
+		}
+		ret.Include = append(ret.Include, v)
+	}
+	rules, ok := main["rule"].(map[string]interface{})
+	if v, exists := main["rule"]; exists && v != nil && !ok {
+		return nil, fmt.Errorf("%s: rule must be a map of host -> rule, got %T", filePath, v)
+	}
+	if rules == nil {
+		rules = make(map[string]interface{})
+	}
+	for _, fileName := range includes {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		sub, pos, err := decodeConfigFile(fileName, data)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range pos {
+			if strings.HasPrefix(k, configKey(configKey("", "rule"), "")) { //rule本身的位置用主文件的
+				ret.Pos[k] = v
+			}
+		}
+		for k := range sub {
+			if k != "rule" {
+				return nil, fmt.Errorf("%s: only rule can be defined in included file, got %q", fileName, k)
+			}
+		}
+		subRules, ok := sub["rule"].(map[string]interface{})
+		if v, exists := sub["rule"]; exists && v != nil && !ok {
+			return nil, fmt.Errorf("%s: rule must be a map of host -> rule, got %T", fileName, v)
+		}
+		for host, rule := range subRules {
+			if _, ok := rules[host]; ok {
+				other := ret.RuleFile[host]
+				if other == "" {
+					other = filePath
+				}
+				return nil, fmt.Errorf("%s: rule %q is already defined in %s", fileName, host, other)
+			}
+			rules[host] = rule
+			ret.RuleFile[host] = fileName
+		}
+		ret.Files = append(ret.Files, fileName)
+	}
+	main["rule"] = rules
+
+	if ret.Data, err = json.Marshal(main); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// include可以是字符串或字符串数组，返回pattern列表和展开后的文件
+func configIncludes(filePath string, v interface{}) ([]string, []string, error) {
+	var patterns []string
+	switch v := v.(type) {
+	case nil:
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: include must be strings", filePath)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, nil, fmt.Errorf("%s: include must be strings", filePath)
+	}
+
+	dir := filepath.Dir(filePath)
+	ret := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, v := range patterns {
+		pattern := v
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+		sort.Strings(matches)
+		for _, v := range matches {
+			if !seen[v] && v != filePath {
+				seen[v] = true
+				ret = append(ret, v)
+			}
+		}
+	}
+	return patterns, ret, nil
+}
+
+// 按原来的文件拆分保存：include文件中的rule写回各自文件，其余写回主文件
+func (this *Config) saveFiles() error {
+	data, err := json.Marshal(this)
+	if err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&all); err != nil {
+		return err
+	}
+
+	pruneEmpty(all)
+
+	rules, _ := all["rule"].(map[string]interface{})
+	split := make(map[string]map[string]interface{})
+	for _, fileName := range this.Files[1:] {
+		split[fileName] = make(map[string]interface{})
+	}
+	for host, fileName := range this.RuleFile {
+		if rule, ok := rules[host]; ok {
+			split[fileName][host] = rule
+			delete(rules, host)
+		}
+	}
+
+	for fileName, v := range split {
+		data, err := encodeConfigFile(fileName, map[string]interface{}{"rule": v})
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(fileName, data, 0644); err != nil {
+			return err
+		}
+	}
+	data, err = encodeConfigFile(this.FilePath, all)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(this.FilePath, data, 0644)
+}
+
+// 去掉null和空的map、数组，如没有配置的defaultOption: {}、defaultSecret: null，避免写回时多出这些没用的key
+func pruneEmpty(m map[string]interface{}) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			if k == "rule" { //没有任何字段的rule也是一个实验，不能去掉
+				for _, rule := range v {
+					if rule, ok := rule.(map[string]interface{}); ok {
+						pruneEmpty(rule)
+					}
+				}
+				continue
+			}
+			pruneEmpty(v)
+			if len(v) == 0 {
+				delete(m, k)
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				delete(m, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSaveFilesOmitsEmpty(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.yaml")
+	text := "defaultServer:\n  groupA: [127.0.0.1:9001]\n  groupB: [127.0.0.1:9002]\nrule:\n  a.com: {}\n  b.com:\n    versions: [v1]\n"
+	if err := os.WriteFile(fileName, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.adminWritable(); err == nil {
+		t.Error("admin changes to a YAML config should be refused")
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"defaultOption", "defaultSecret", "null"} {
+		if strings.Contains(string(data), v) {
+			t.Errorf("saved config contains %q:\n%s", v, data)
+		}
+	}
+	saved, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.Rule["a.com"]; !ok || !reflect.DeepEqual(saved.Rule, c.Rule) { //空的rule也要保留
+		t.Errorf("rules changed after save: %+v, expect %+v", saved.Rule, c.Rule)
+	}
+}
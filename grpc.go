@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// grpc的content-type为application/grpc或application/grpc+proto等
+func isGrpc(h http.Header) bool {
+	ct := h.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return false
+	}
+	return len(ct) == len("application/grpc") || ct[len("application/grpc")] == '+' || ct[len("application/grpc")] == ';'
+}
+
+// 请求对应的规则key，grpc请求依次匹配 host/包名.服务名/方法名、host/包名.服务名、host
+func ruleHost(c *Config, r *http.Request) string {
+	if !isGrpc(r.Header) || c.Rule == nil {
+		return r.Host
+	}
+	path := r.URL.Path
+	if _, ok := c.Rule[r.Host+path]; ok {
+		return r.Host + path
+	}
+	if i := strings.LastIndexByte(path, '/'); i > 0 {
+		if _, ok := c.Rule[r.Host+path[:i]]; ok {
+			return r.Host + path[:i]
+		}
+	}
+	return r.Host
+}
+
+// UNAVAILABLE，grpc客户端据此重试
+const grpcUnavailable = "14"
+
+// 转发失败：grpc客户端只认grpc-status，返回200和trailer中的UNAVAILABLE，其余返回503
+func backendError(w http.ResponseWriter, r *http.Request, msg string) {
+	if !isGrpc(r.Header) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(msg))
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	h.Set("Grpc-Status", grpcUnavailable)
+	h.Set("Grpc-Message", grpcMessage(msg))
+}
+
+// grpc-message按规范对非可见ASCII字符和%做百分号编码
+func grpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpc状态码一般在trailer中，没有响应体时直接放在header中
+func grpcStatus(resp *http.Response) string {
+	if v := resp.Trailer.Get("Grpc-Status"); v != "" {
+		return v
+	}
+	return resp.Header.Get("Grpc-Status")
+}
+
+// 先在响应头中声明trailer，响应体写完后再调用copyTrailer
+func announceTrailer(w http.ResponseWriter, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	w.Header().Add("Trailer", strings.Join(keys, ", "))
+	return len(keys)
+}
+
+// 上游在响应体中途新增的trailer没有声明过，需要加TrailerPrefix
+func copyTrailer(w http.ResponseWriter, resp *http.Response, announced int) {
+	for k, vv := range resp.Trailer {
+		if len(resp.Trailer) != announced {
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+}
@@ -6,54 +6,93 @@ import (
 
 type ZeroValue struct{}
 
-type SetMap struct {
+// 带类型的集合，读写都加锁；Union、Difference返回新集合，不修改原集合
+type Set[T comparable] struct {
 	*sync.RWMutex
-	items map[interface{}]ZeroValue
+	items map[T]ZeroValue
 }
 
-func NewSet() *SetMap {
-	return &SetMap{
+func NewSet[T comparable](v ...T) *Set[T] {
+	this := &Set[T]{
 		&sync.RWMutex{},
-		make(map[interface{}]ZeroValue),
+		make(map[T]ZeroValue, len(v)),
 	}
+	for _, _v := range v {
+		this.items[_v] = ZeroValue{}
+	}
+	return this
 }
 
 //添加
-func (this *SetMap) Add(v ...interface{}) (ret bool) {
+func (this *Set[T]) Add(v ...T) {
 	this.Lock()
 	defer this.Unlock()
-	ret = true
 	for _, _v := range v {
 		this.items[_v] = ZeroValue{}
 	}
-	return
 }
 
-//查询
-func (this *SetMap) Has(v interface{}) (ret bool) {
-	ret = false
-	if _, ok := this.items[v]; ok {
-		ret = true
+//查询，nil集合什么都不包含
+func (this *Set[T]) Has(v T) bool {
+	if this == nil {
+		return false
 	}
-	return
+	this.RLock()
+	defer this.RUnlock()
+	_, ok := this.items[v]
+	return ok
 }
 
 //删除
-func (this *SetMap) Remove(v ...interface{}) (ret bool) {
+func (this *Set[T]) Remove(v ...T) {
 	this.Lock()
 	defer this.Unlock()
-	ret = true
 	for _, _v := range v {
 		delete(this.items, _v)
 	}
-	return
 }
 
 //清空重置
-func (this *SetMap) Clear() (ret bool) {
+func (this *Set[T]) Clear() {
 	this.Lock()
 	defer this.Unlock()
-	ret = true
-	this.items = make(map[interface{}]ZeroValue)
-	return
+	this.items = make(map[T]ZeroValue)
+}
+
+//元素个数
+func (this *Set[T]) Len() int {
+	if this == nil {
+		return 0
+	}
+	this.RLock()
+	defer this.RUnlock()
+	return len(this.items)
+}
+
+//当前元素的快照，顺序不固定
+func (this *Set[T]) Items() []T {
+	if this == nil {
+		return nil
+	}
+	this.RLock()
+	defer this.RUnlock()
+	ret := make([]T, 0, len(this.items))
+	for k := range this.items {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+//并集
+func (this *Set[T]) Union(other *Set[T]) *Set[T] {
+	ret := NewSet(this.Items()...)
+	ret.Add(other.Items()...)
+	return ret
+}
+
+//差集：在this中但不在other中
+func (this *Set[T]) Difference(other *Set[T]) *Set[T] {
+	ret := NewSet(this.Items()...)
+	ret.Remove(other.Items()...)
+	return ret
 }
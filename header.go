@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// 逐跳请求头(RFC 7230 6.1)，只对当前连接有效，不能转发
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardedHeaders可选的值
+const (
+	forwardedX    = "x-forwarded" //X-Forwarded-For/Proto/Host，默认
+	forwardedStd  = "forwarded"   //RFC 7239 Forwarded
+	forwardedBoth = "both"
+	forwardedNone = "none"
+)
+
+// 按host改写请求头和响应头
+type ConfigHeaderRewrite struct {
+	Request  *ConfigHeaderOps `json:"request,omitempty"`
+	Response *ConfigHeaderOps `json:"response,omitempty"`
+}
+
+// 依次执行remove、set、add
+type ConfigHeaderOps struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+func (this *ConfigHeaderOps) names() []string {
+	if this == nil {
+		return nil
+	}
+	ret := append([]string{}, this.Remove...)
+	for k := range this.Set {
+		ret = append(ret, k)
+	}
+	for k := range this.Add {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func validHeaderName(v string) bool {
+	return v != "" && !strings.ContainsAny(v, " \t\r\n:")
+}
+
+func (this *ConfigHeaderOps) apply(h http.Header) {
+	if this == nil {
+		return
+	}
+	for _, k := range this.Remove {
+		h.Del(k)
+	}
+	for k, v := range this.Set {
+		h.Set(k, v)
+	}
+	for k, v := range this.Add {
+		h.Add(k, v)
+	}
+}
+
+// 去掉逐跳请求头，包括Connection中列出的；grpc依赖的"TE: trailers"保留
+func removeHopHeaders(h http.Header) {
+	keepTrailers := false
+	for _, v := range h.Values("Te") {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), "trailers") {
+				keepTrailers = true
+			}
+		}
+	}
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if keepTrailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// 直连的地址
+func peerAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// Forwarded中的节点，ipv6需要加引号和方括号
+func forwardedNode(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "unknown"
+	}
+	if addr.Is6() {
+		return `"[` + addr.String() + `]"`
+	}
+	return addr.String()
+}
+
+// 设置转发相关的请求头：直连地址在trustedProxies中时保留并追加上一跳代理传来的值，否则丢弃客户端传来的值
+func setForwardedHeaders(c *Config, h http.Header, r *http.Request) {
+	mode := c.ForwardedHeaders
+	if mode == "" {
+		mode = forwardedX
+	}
+	peer := peerAddr(r)
+	trusted := containsAddr(c.TrustedNets, peer)
+	if !trusted {
+		for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			h.Del(k)
+		}
+	}
+	if mode == forwardedNone {
+		return
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if mode == forwardedX || mode == forwardedBoth {
+		list := h.Values("X-Forwarded-For")
+		if peer.IsValid() {
+			list = append(list, peer.String())
+		}
+		if len(list) > 0 {
+			h.Set("X-Forwarded-For", strings.Join(list, ", "))
+		}
+		if h.Get("X-Forwarded-Proto") == "" {
+			h.Set("X-Forwarded-Proto", proto)
+		}
+		if h.Get("X-Forwarded-Host") == "" {
+			h.Set("X-Forwarded-Host", r.Host)
+		}
+	}
+	if mode == forwardedStd || mode == forwardedBoth {
+		list := h.Values("Forwarded")
+		list = append(list, "for="+forwardedNode(peer)+`;host="`+r.Host+`";proto=`+proto)
+		h.Set("Forwarded", strings.Join(list, ", "))
+	}
+}
+
+// 转发给上游的请求头：不修改原请求，去掉逐跳请求头，加上转发信息，再按host改写
+func upstreamHeader(c *Config, r *http.Request, host string) http.Header {
+	h := r.Header.Clone()
+	removeHopHeaders(h)
+	setForwardedHeaders(c, h, r)
+	if v, ok := c.Rule[host]; ok && v.Headers != nil {
+		v.Headers.Request.apply(h)
+	}
+	return h
+}
+
+// 上游的响应头：去掉逐跳响应头，再按host改写
+func copyResponseHeader(c *Config, w http.ResponseWriter, resp *http.Response, host string) {
+	removeHopHeaders(resp.Header)
+	dst := w.Header()
+	for k, v := range resp.Header {
+		dst[k] = append(dst[k], v...)
+	}
+	if v, ok := c.Rule[host]; ok && v.Headers != nil {
+		v.Headers.Response.apply(dst)
+	}
+}
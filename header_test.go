@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// 记录收到的请求头，并按respHeader返回响应头
+type testBackend struct {
+	sync.Mutex
+	header     http.Header
+	respHeader http.Header
+}
+
+func (this *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.Lock()
+	defer this.Unlock()
+	this.header = r.Header.Clone()
+	for k, v := range this.respHeader {
+		w.Header()[k] = v
+	}
+	w.Write([]byte("ok"))
+}
+
+func (this *testBackend) received() http.Header {
+	this.Lock()
+	defer this.Unlock()
+	return this.header
+}
+
+// 按cfg生成配置文件并作为当前配置，defaultServer指向backend
+func testProxyConfig(t *testing.T, backend *httptest.Server, cfg map[string]interface{}) *Config {
+	dir := t.TempDir()
+	cfg["log"] = map[string]string{"dir": dir + "/", "format": "test.log"}
+	cfg["defaultServer"] = map[string][]string{"groupA": {backend.Listener.Addr().String()}, "groupB": {backend.Listener.Addr().String()}}
+	data, _ := json.Marshal(cfg)
+	fileName := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Store(c)
+	mylogger = NewLogger(c.GetLogDir(), c.GetLogFormat(), c.GetLogPrefix())
+	return c
+}
+
+func TestHopHeaders(t *testing.T) {
+	backend := &testBackend{respHeader: http.Header{
+		"Connection":  {"X-Internal"},
+		"X-Internal":  {"1"},
+		"Keep-Alive":  {"timeout=5"},
+		"X-Response":  {"kept"},
+		"Content-Md5": {"kept"},
+	}}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	testProxyConfig(t, server, map[string]interface{}{})
+
+	cases := []struct {
+		name, te, wantTE string
+	}{
+		{"te trailers", "trailers, deflate", "trailers"},
+		{"te without trailers", "gzip", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.Host = "hop.example.com"
+		req.Header.Set("Connection", "keep-alive, X-Secret")
+		req.Header.Set("X-Secret", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authorization", "Basic eA==")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Te", tc.te)
+		req.Header.Set("X-Request", "kept")
+		rec := httptest.NewRecorder()
+		proxy(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.name, rec.Code, rec.Body)
+		}
+
+		got := backend.received()
+		for _, k := range []string{"X-Secret", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection"} {
+			if v := got.Get(k); v != "" {
+				t.Errorf("%s: upstream got %s: %s", tc.name, k, v)
+			}
+		}
+		if v := got.Get("Te"); v != tc.wantTE {
+			t.Errorf("%s: upstream got TE %q, expect %q", tc.name, v, tc.wantTE)
+		}
+		if got.Get("X-Request") != "kept" {
+			t.Errorf("%s: upstream lost X-Request: %v", tc.name, got)
+		}
+		for _, k := range []string{"Connection", "X-Internal", "Keep-Alive"} {
+			if v := rec.Header().Get(k); v != "" {
+				t.Errorf("%s: client got %s: %s", tc.name, k, v)
+			}
+		}
+		if rec.Header().Get("X-Response") != "kept" {
+			t.Errorf("%s: client lost X-Response: %v", tc.name, rec.Header())
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := &testBackend{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	spoofed := map[string]string{
+		"X-Forwarded-For":   "1.2.3.4",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.example.com",
+		"Forwarded":         "for=1.2.3.4",
+	}
+	cases := []struct {
+		name     string
+		mode     string
+		trusted  []string
+		remote   string
+		incoming map[string]string
+		want     map[string]string //""表示不应该有这个请求头
+	}{
+		{"untrusted spoofed", "", nil, "192.0.2.1:1234", spoofed, map[string]string{
+			"X-Forwarded-For": "192.0.2.1", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "fwd.example.com", "Forwarded": "",
+		}},
+		{"trusted proxy", "", []string{"192.0.2.0/24"}, "192.0.2.1:1234", spoofed, map[string]string{
+			"X-Forwarded-For": "1.2.3.4, 192.0.2.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com", "Forwarded": "for=1.2.3.4",
+		}},
+		{"untrusted forwarded", forwardedStd, []string{"10.0.0.0/8"}, "[2001:db8::1]:1234", spoofed, map[string]string{
+			"X-Forwarded-For": "", "X-Forwarded-Proto": "", "Forwarded": `for="[2001:db8::1]";host="fwd.example.com";proto=http`,
+		}},
+		{"trusted both", forwardedBoth, []string{"192.0.2.1"}, "192.0.2.1:1234", spoofed, map[string]string{
+			"X-Forwarded-For": "1.2.3.4, 192.0.2.1", "Forwarded": `for=1.2.3.4, for=192.0.2.1;host="fwd.example.com";proto=http`,
+		}},
+		{"none", forwardedNone, nil, "192.0.2.1:1234", spoofed, map[string]string{
+			"X-Forwarded-For": "", "X-Forwarded-Proto": "", "X-Forwarded-Host": "", "Forwarded": "",
+		}},
+	}
+	for _, tc := range cases {
+		testProxyConfig(t, server, map[string]interface{}{"forwardedHeaders": tc.mode, "trustedProxies": tc.trusted})
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.Host = "fwd.example.com"
+		req.RemoteAddr = tc.remote
+		for k, v := range tc.incoming {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		proxy(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.name, rec.Code, rec.Body)
+		}
+		got := backend.received()
+		for k, v := range tc.want {
+			if got.Get(k) != v {
+				t.Errorf("%s: upstream got %s: %q, expect %q", tc.name, k, got.Get(k), v)
+			}
+		}
+	}
+}
+
+// 请求头和响应头都按remove、set、add的顺序改写
+func TestRuleHeaders(t *testing.T) {
+	backend := &testBackend{respHeader: http.Header{"X-Powered-By": {"php"}, "X-Resp": {"backend"}}}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	testProxyConfig(t, server, map[string]interface{}{
+		"rule": map[string]interface{}{
+			"rw.example.com": map[string]interface{}{
+				"headers": map[string]interface{}{
+					"request": map[string]interface{}{
+						"remove": []string{"X-A", "Cookie"},
+						"set":    map[string]string{"X-A": "set"},
+						"add":    map[string]string{"X-A": "add"},
+					},
+					"response": map[string]interface{}{
+						"remove": []string{"X-Powered-By", "X-Resp"},
+						"set":    map[string]string{"X-Resp": "proxy"},
+						"add":    map[string]string{"X-Resp": "added"},
+					},
+				},
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/path", nil)
+	req.Host = "rw.example.com"
+	req.Header.Set("X-A", "client")
+	req.Header.Set("Cookie", "a=b")
+	rec := httptest.NewRecorder()
+	proxy(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	got := backend.received()
+	if v := got.Values("X-A"); !reflect.DeepEqual(v, []string{"set", "add"}) {
+		t.Errorf("upstream got X-A %q, expect [set add]", v)
+	}
+	if v := got.Get("Cookie"); v != "" {
+		t.Errorf("upstream got Cookie %q", v)
+	}
+	if v := rec.Header().Values("X-Resp"); !reflect.DeepEqual(v, []string{"proxy", "added"}) {
+		t.Errorf("client got X-Resp %q, expect [proxy added]", v)
+	}
+	if v := rec.Header().Get("X-Powered-By"); v != "" {
+		t.Errorf("client got X-Powered-By %q", v)
+	}
+	if req.Header.Get("X-A") != "client" {
+		t.Error("rewriting modified the incoming request")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 配置历史快照，每次成功重新加载或修改配置前保存旧配置，用于回滚
+type ConfigSnapshot struct {
+	Id       string            `json:"id"`
+	Time     time.Time         `json:"time"`
+	Version  string            `json:"version"` //旧配置的内容摘要
+	Source   string            `json:"source"`  //触发替换的来源：watch/signal/admin/rollback
+	Files    []string          `json:"files"`
+	RuleFile map[string]string `json:"ruleFile,omitempty"`
+	Hosts    int               `json:"hosts"`
+	Config   json.RawMessage   `json:"config,omitempty"`
+}
+
+// 历史目录，没有配置时为配置文件所在目录下的.abtest_history
+func historyDir(filePath string, option ConfigOption) string {
+	if option.HistoryDir != "" {
+		return option.HistoryDir
+	}
+	if isRemoteConfig(filePath) {
+		return filepath.Join(os.TempDir(), "abtest_history")
+	}
+	return filepath.Join(filepath.Dir(filePath), ".abtest_history")
+}
+
+// 保存被替换掉的配置，和最近一次快照内容相同时跳过；快照中有密钥和token，只有本用户可读
+func saveHistory(old *Config, source string) error {
+	dir := historyDir(old.FilePath, old.Option)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil { //之前的版本创建的目录是0755
+		return err
+	}
+	list, err := listHistory(dir)
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 && list[0].Version == old.Version {
+		return nil
+	}
+
+	data, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	snap := &ConfigSnapshot{
+		Id:       now.Format("20060102T150405.000") + "-" + old.Version,
+		Time:     now,
+		Version:  old.Version,
+		Source:   source,
+		Files:    old.Files,
+		RuleFile: old.RuleFile,
+		Hosts:    len(old.Rule),
+		Config:   data,
+	}
+	if data, err = json.MarshalIndent(snap, "", "  "); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, snap.Id+".json"), data, 0600); err != nil {
+		return err
+	}
+
+	if limit := old.Option.HistoryLimit; limit > 0 && len(list) >= limit { //超过数量的删除最旧的
+		for _, v := range list[limit-1:] {
+			os.Remove(filepath.Join(dir, v.Id+".json"))
+		}
+	}
+	return nil
+}
+
+// 按时间倒序列出快照，不含配置内容
+func listHistory(dir string) ([]*ConfigSnapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*ConfigSnapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*ConfigSnapshot, 0, len(entries))
+	for _, v := range entries {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), ".json") {
+			continue
+		}
+		snap, err := readHistory(filepath.Join(dir, v.Name()))
+		if err != nil {
+			continue
+		}
+		snap.Config = nil
+		ret = append(ret, snap)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id > ret[j].Id
+	})
+	return ret, nil
+}
+
+func readHistory(fileName string) (*ConfigSnapshot, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	snap := &ConfigSnapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return snap, nil
+}
+
+// 按id查找快照，可以只给出id的前缀或内容摘要
+func findHistory(dir, id string) (*ConfigSnapshot, error) {
+	list, err := listHistory(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found *ConfigSnapshot
+	for _, v := range list {
+		if v.Id == id {
+			found = v
+			break
+		}
+		if strings.HasPrefix(v.Id, id) || v.Version == id {
+			if found != nil && found.Version != v.Version {
+				return nil, fmt.Errorf("history %s is ambiguous", id)
+			}
+			if found == nil {
+				found = v
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("history %s not found", id)
+	}
+	return readHistory(filepath.Join(dir, found.Id+".json"))
+}
+
+// 把快照还原成配置，文件拆分按快照时的include文件
+func (this *ConfigSnapshot) Restore(filePath string) (*Config, error) {
+	if len(this.Config) == 0 {
+		return nil, errors.New("empty history " + this.Id)
+	}
+	next := NewConfig(filePath)
+	if err := json.Unmarshal(this.Config, next); err != nil {
+		return nil, err
+	}
+	next.Files, next.RuleFile = this.Files, this.RuleFile
+	if len(next.Files) == 0 {
+		next.Files = []string{filePath}
+	}
+	var err error
+	if next.Option, err = next.Default.effective(); err != nil {
+		return nil, err
+	}
+	next.Version = this.Version
+	return next, nil
+}
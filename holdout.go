@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+)
+
+const (
+	holdoutBuckets = 10000 //按万分之一划分，holdout最小为0.01%
+	holdoutHeader  = "AB-HOLDOUT"
+)
+
+const (
+	holdoutGlobal     = "global"
+	holdoutRule       = "rule"
+	holdoutExperiment = "experiment"
+)
+
+// 访客是否在保留组中：按salt和访客id计算，同一访客每次结果都一样
+func inHoldout(salt, id string, percent float64) bool {
+	if percent <= 0 || id == "" {
+		return false
+	}
+	return float64(hashBucket("holdout:"+salt, id, holdoutBuckets)) < percent*holdoutBuckets/100
+}
+
+// 访客所在的保留组：global为所有实验的保留组，rule为该host的保留组，都不在时返回""
+func (this *Config) HoldoutOf(host, id string) string {
+	if inHoldout("", id, this.Holdout) {
+		return holdoutGlobal
+	}
+	if v, ok := this.Rule[host]; ok && inHoldout(host, id, v.Holdout) {
+		return holdoutRule
+	}
+	return ""
+}
+
+// 是否需要访客id：配置了保留组、实验层，或者需要记录曝光
+func (this *Config) NeedVisitor(host string) bool {
+	if this.Holdout > 0 {
+		return true
+	}
+	v, ok := this.Rule[host]
+	return ok && (v.Holdout > 0 || len(v.Layers) > 0 || this.Events != nil)
+}
+
+// 需要时才取访客id，避免给没有用到的host种cookie
+func hostVisitorId(c *Config, w http.ResponseWriter, r *http.Request, host string) string {
+	if !c.NeedVisitor(host) {
+		return ""
+	}
+	return visitorId(c, w, r)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHoldoutShare(t *testing.T) {
+	c := &Config{
+		Holdout: 5,
+		Rule:    map[string]ConfigRule{"a.com": {Holdout: 10}},
+	}
+	layers := map[string]ConfigLayer{
+		"l": {Experiments: []ConfigExperiment{{Name: "e", From: 0, To: 999, Holdout: 20}}},
+	}
+	ids := testVisitors(20000)
+	count := make(map[string]int)
+	for _, id := range ids {
+		scope := c.HoldoutOf("a.com", id)
+		if again := c.HoldoutOf("a.com", id); again != scope {
+			t.Fatalf("%s: holdout changed from %q to %q", id, scope, again)
+		}
+		count[scope]++
+		if list := assignLayers(layers, id); list[0].Holdout {
+			count[holdoutExperiment]++
+		}
+	}
+	if c.HoldoutOf("a.com", "") != "" {
+		t.Error("a request without visitor id should not be held out")
+	}
+	//全局5%，剩下的95%中rule再留10%，实验层独立留20%
+	for scope, want := range map[string]float64{holdoutGlobal: 0.05, holdoutRule: 0.095, holdoutExperiment: 0.2} {
+		if got := float64(count[scope]) / float64(len(ids)); math.Abs(got-want) > 0.015 {
+			t.Errorf("%s holdout share %.3f, expect %.3f", scope, got, want)
+		}
+	}
+}
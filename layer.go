@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	layerBuckets      = 1000 //每层的桶数
+	experimentsHeader = "AB-EXPERIMENTS"
+)
+
+// 实验层：同一层内的实验占用不重叠的桶，互斥；不同层用不同的hash，相互正交
+type ConfigLayer struct {
+	Experiments []ConfigExperiment `json:"experiments"`
+}
+
+type ConfigExperiment struct {
+	Name     string          `json:"name"`
+	From     int             `json:"from"` //占用本层的桶[from, to]，0-999
+	To       int             `json:"to"`
+	Variants []ConfigVariant `json:"variants,omitempty"` //默认a、b各一半
+	Holdout  float64         `json:"holdout,omitempty"`  //命中本实验桶的访客中不参与实验的百分比
+}
+
+type ConfigVariant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+var defaultVariants = []ConfigVariant{{"a", 1}, {"b", 1}}
+
+// 一个实验的分配结果
+type assignment struct {
+	Experiment string
+	Variant    string
+	Holdout    bool //在实验的保留组中，不参与实验
+}
+
+// 按salt和访客id计算桶号，结果只和id有关，同一访客每次都一样
+func hashBucket(salt, id string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	return int(h.Sum64() % uint64(n))
+}
+
+// 实验内按权重分配分组，和层的桶号使用不同的hash
+func (this ConfigExperiment) variant(id string) (string, bool) {
+	variants := this.Variants
+	if len(variants) == 0 {
+		variants = defaultVariants
+	}
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return "", false
+	}
+	n := hashBucket("experiment:"+this.Name, id, total)
+	for _, v := range variants {
+		if n < v.Weight {
+			return v.Name, true
+		}
+		n -= v.Weight
+	}
+	return "", false
+}
+
+// 按层计算访客参与的所有实验，按实验名排序
+func assignLayers(layers map[string]ConfigLayer, id string) []assignment {
+	ret := make([]assignment, 0, len(layers))
+	for name, layer := range layers {
+		bucket := hashBucket("layer:"+name, id, layerBuckets)
+		for _, e := range layer.Experiments {
+			if bucket < e.From || bucket > e.To {
+				continue
+			}
+			if inHoldout("experiment:"+e.Name, id, e.Holdout) {
+				ret = append(ret, assignment{e.Name, "", true})
+			} else if v, ok := e.variant(id); ok {
+				ret = append(ret, assignment{e.Name, v, false})
+			}
+			break //同一层只会命中一个实验
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Experiment < ret[j].Experiment
+	})
+	return ret
+}
+
+func formatAssignments(list []assignment) string {
+	items := make([]string, 0, len(list))
+	for _, v := range list {
+		if v.Holdout {
+			continue
+		}
+		items = append(items, v.Experiment+"="+v.Variant)
+	}
+	return strings.Join(items, ";")
+}
+
+// 访客id：优先取cookie，没有时生成一个并通过响应写回
+func visitorId(c *Config, w http.ResponseWriter, r *http.Request) string {
+	name := c.Option.VisitorCookie
+	if v, err := r.Cookie(name); err == nil && v.Value != "" {
+		return v.Value
+	}
+	id := newUUID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+	})
+	r.AddCookie(&http.Cookie{Name: name, Value: id}) //本次请求也带给后端
+	return id
+}
+
+// 检查层内实验的桶范围、重叠和实验名
+func checkLayers(layers map[string]ConfigLayer) []string {
+	errs := make([]string, 0)
+	names := make(map[string]string)
+	for layerName, layer := range layers {
+		used := make([]string, layerBuckets)
+		for _, e := range layer.Experiments {
+			if e.Name == "" || strings.ContainsAny(e.Name, "=;, ") {
+				errs = append(errs, fmt.Sprintf("layer %s: invalid experiment name %q", layerName, e.Name))
+			}
+			if other, ok := names[e.Name]; ok {
+				errs = append(errs, fmt.Sprintf("layer %s: experiment %s is already defined in layer %s", layerName, e.Name, other))
+			}
+			names[e.Name] = layerName
+			if e.Holdout < 0 || e.Holdout >= 100 {
+				errs = append(errs, fmt.Sprintf("layer %s: experiment %s holdout must be in [0, 100)", layerName, e.Name))
+			}
+			if e.From < 0 || e.To >= layerBuckets || e.From > e.To {
+				errs = append(errs, fmt.Sprintf("layer %s: experiment %s buckets must satisfy 0 <= from <= to < %d", layerName, e.Name, layerBuckets))
+				continue
+			}
+			for i := e.From; i <= e.To; i++ {
+				if used[i] != "" {
+					errs = append(errs, fmt.Sprintf("layer %s: experiments %s and %s overlap at bucket %d", layerName, used[i], e.Name, i))
+					break
+				}
+				used[i] = e.Name
+			}
+			for _, v := range e.Variants {
+				if v.Name == "" || v.Weight <= 0 {
+					errs = append(errs, fmt.Sprintf("layer %s: experiment %s needs variant names and positive weights", layerName, e.Name))
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// 固定的访客id，结果可以重现
+func testVisitors(n int) []string {
+	ret := make([]string, n)
+	for i := range ret {
+		ret[i] = fmt.Sprintf("visitor-%d", i)
+	}
+	return ret
+}
+
+func TestLayerExclusive(t *testing.T) {
+	layers := map[string]ConfigLayer{
+		"l": {Experiments: []ConfigExperiment{
+			{Name: "e1", From: 0, To: 299},
+			{Name: "e2", From: 300, To: 999},
+		}},
+	}
+	count := make(map[string]int)
+	for _, id := range testVisitors(20000) {
+		list := assignLayers(layers, id)
+		if len(list) != 1 {
+			t.Fatalf("%s: %d experiments in one layer: %+v", id, len(list), list)
+		}
+		bucket := hashBucket("layer:l", id, layerBuckets)
+		if want := map[bool]string{true: "e1", false: "e2"}[bucket < 300]; list[0].Experiment != want {
+			t.Fatalf("%s: bucket %d assigned to %s, expect %s", id, bucket, list[0].Experiment, want)
+		}
+		if again := assignLayers(layers, id); again[0] != list[0] {
+			t.Fatalf("%s: assignment changed from %+v to %+v", id, list[0], again[0])
+		}
+		count[list[0].Experiment+"="+list[0].Variant]++
+	}
+	for k, want := range map[string]float64{"e1=a": 0.15, "e1=b": 0.15, "e2=a": 0.35, "e2=b": 0.35} {
+		if got := float64(count[k]) / 20000; math.Abs(got-want) > 0.02 {
+			t.Errorf("%s: share %.3f, expect %.2f", k, got, want)
+		}
+	}
+}
+
+// 不同层的分配相互独立：一层的结果不影响另一层
+func TestLayerIndependent(t *testing.T) {
+	layers := map[string]ConfigLayer{
+		"x": {Experiments: []ConfigExperiment{{Name: "x1", From: 0, To: 499}, {Name: "x2", From: 500, To: 999}}},
+		"y": {Experiments: []ConfigExperiment{{Name: "y1", From: 0, To: 499}, {Name: "y2", From: 500, To: 999}}},
+	}
+	count := make(map[string]int)
+	for _, id := range testVisitors(20000) {
+		list := assignLayers(layers, id)
+		if len(list) != 2 {
+			t.Fatalf("%s: expect one experiment per layer, got %+v", id, list)
+		}
+		count[list[0].Experiment+","+list[1].Experiment]++
+	}
+	for _, k := range []string{"x1,y1", "x1,y2", "x2,y1", "x2,y2"} {
+		if got := float64(count[k]) / 20000; math.Abs(got-0.25) > 0.02 {
+			t.Errorf("%s: share %.3f, expect 0.25", k, got)
+		}
+	}
+}
+
+func TestCheckLayers(t *testing.T) {
+	layers := map[string]ConfigLayer{
+		"l": {Experiments: []ConfigExperiment{
+			{Name: "e1", From: 0, To: 499, Holdout: 100},
+			{Name: "e2", From: 400, To: 999, Holdout: -1},
+		}},
+	}
+	want := []string{
+		"layer l: experiment e1 holdout must be in [0, 100)",
+		"layer l: experiment e2 holdout must be in [0, 100)",
+		"layer l: experiments e1 and e2 overlap at bucket 400",
+	}
+	if got := checkLayers(layers); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, expect %q", got, want)
+	}
+}
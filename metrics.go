@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var metrics = NewMetrics()
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 来自请求的标签值不在配置中时统一记为other，防止客户端用任意host或路径撑大指标
+const metricOther = "other"
+
+// host标签：只保留配置了规则的host
+func (this *Config) MetricHost(host string) string {
+	if _, ok := this.Rule[host]; ok {
+		return host
+	}
+	return metricOther
+}
+
+// grpc的method标签：只有按 host/服务 或 host/服务/方法 配置了规则时才记录具体方法
+func (this *Config) MetricMethod(host, path string) string {
+	if _, ok := this.Rule[host]; ok && strings.Contains(host, "/") {
+		return path
+	}
+	return metricOther
+}
+
+// 简单的计数器，按prometheus文本格式输出
+type ZdMetrics struct {
+	*sync.RWMutex
+	items map[string]*int64 //key为 name{label="value",...}
+}
+
+func NewMetrics() *ZdMetrics {
+	return &ZdMetrics{
+		&sync.RWMutex{},
+		make(map[string]*int64),
+	}
+}
+
+// labels按key,value成对传入
+func metricKey(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (this *ZdMetrics) get(name string, labels []string) *int64 {
+	key := metricKey(name, labels)
+	this.RLock()
+	v, ok := this.items[key]
+	this.RUnlock()
+	if ok {
+		return v
+	}
+	this.Lock()
+	defer this.Unlock()
+	if v, ok = this.items[key]; !ok {
+		v = new(int64)
+		this.items[key] = v
+	}
+	return v
+}
+
+// 计数加1
+func (this *ZdMetrics) Inc(name string, labels ...string) {
+	atomic.AddInt64(this.get(name, labels), 1)
+}
+
+// 计数增加delta
+func (this *ZdMetrics) Add(name string, delta int64, labels ...string) {
+	atomic.AddInt64(this.get(name, labels), delta)
+}
+
+// 设置为当前值，用于gauge
+func (this *ZdMetrics) Set(name string, value int64, labels ...string) {
+	atomic.StoreInt64(this.get(name, labels), value)
+}
+
+// 删除不再使用的gauge，如已经移除的人群文件
+func (this *ZdMetrics) Delete(name string, labels ...string) {
+	key := metricKey(name, labels)
+	this.Lock()
+	delete(this.items, key)
+	this.Unlock()
+}
+
+func (this *ZdMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//在锁内复制，之后Delete删掉的指标不影响输出
+	this.RLock()
+	keys := make([]string, 0, len(this.items))
+	values := make(map[string]int64, len(this.items))
+	for k, v := range this.items {
+		keys = append(keys, k)
+		values[k] = atomic.LoadInt64(v)
+	}
+	this.RUnlock()
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s %d\n", k, values[k])
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultOption配置，优先级：命令行参数 > 环境变量(ABTEST_加大写下划线名，如ABTEST_SOCK_FILE) > 配置文件 > 默认值
+type ConfigOption struct {
+	Port             int    `json:"port,omitempty"`
+	SockFile         string `json:"sockFile,omitempty"` //写入进程pid的文件
+	ParamNameVersion string `json:"paramNameVersion,omitempty"`
+	ParamNameData    string `json:"paramNameData,omitempty"`
+	FlushInterval    int64  `json:"flushInterval,omitempty"` //流式响应刷新间隔(毫秒)，-1表示立即刷新
+	H2C              bool   `json:"h2c,omitempty"`           //http端口同时支持明文HTTP/2
+	ReadTimeout      int64  `json:"readTimeout,omitempty"`   //秒
+	WriteTimeout     int64  `json:"writeTimeout,omitempty"`  //秒，流式响应不受限制
+	IdleTimeout      int64  `json:"idleTimeout,omitempty"`   //秒
+	UpstreamTimeout  int64  `json:"upstreamTimeout,omitempty"`
+	PprofAddr        string `json:"pprofAddr,omitempty"` //单独的pprof监听地址，不做认证，只应监听内网，如127.0.0.1:10000
+	BufferSize       int    `json:"bufferSize,omitempty"`
+	Watch            bool   `json:"watch,omitempty"`           //配置文件及include的文件变化后自动重新加载
+	HistoryDir       string `json:"historyDir,omitempty"`      //配置历史快照目录，默认为配置文件所在目录下的.abtest_history
+	HistoryLimit     int    `json:"historyLimit,omitempty"`    //最多保留的快照数
+	PollInterval     int64  `json:"pollInterval,omitempty"`    //秒，-c为http(s)地址时轮询远程配置的间隔
+	VisitorCookie    string `json:"visitorCookie,omitempty"`   //保存访客id的cookie，实验层按它分桶
+	RequestIdHeader  string `json:"requestIdHeader,omitempty"` //请求id的请求头，客户端传了合法的值时沿用
+
+	present map[string]bool //配置文件中出现过的key，出现过的false、0也覆盖默认值
+}
+
+func defaultOption() ConfigOption {
+	return ConfigOption{
+		Port:             8081,
+		SockFile:         "/tmp/abtest.sock",
+		ParamNameVersion: "__abv",
+		ParamNameData:    "__abd",
+		ReadTimeout:      5,
+		WriteTimeout:     60,
+		IdleTimeout:      300,
+		UpstreamTimeout:  60,
+		BufferSize:       1024 * 32,
+		HistoryLimit:     50,
+		PollInterval:     10,
+		VisitorCookie:    "__abvid",
+		RequestIdHeader:  "AB-REQUEST-ID",
+	}
+}
+
+// 命令行中出现过的defaultOption参数，按json名索引
+var optionFlags = make(map[string]string)
+
+// 每个defaultOption字段对应一个同名命令行参数，如 -port=8081 -sockFile=/tmp/abtest.sock
+func registerOptionFlags(fs *flag.FlagSet) {
+	names, _ := jsonFields(reflect.TypeOf(ConfigOption{}))
+	for _, name := range names {
+		fs.Func(name, "override defaultOption."+name, func(v string) error {
+			optionFlags[name] = v
+			return nil
+		})
+	}
+}
+
+// 热重启时把命令行参数原样传给子进程
+func optionArgs() []string {
+	ret := make([]string, 0, len(optionFlags))
+	for k, v := range optionFlags {
+		ret = append(ret, "-"+k+"="+v)
+	}
+	return ret
+}
+
+// sockFile -> ABTEST_SOCK_FILE
+func optionEnvName(name string) string {
+	var b strings.Builder
+	b.WriteString("ABTEST_")
+	for i, c := range name {
+		if i > 0 && c >= 'A' && c <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(c)
+	}
+	return strings.ToUpper(b.String())
+}
+
+// 记录出现过的key
+func (this *ConfigOption) UnmarshalJSON(data []byte) error {
+	type plain ConfigOption
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, (*plain)(this)); err != nil {
+		return err
+	}
+	this.present = make(map[string]bool, len(keys))
+	for k := range keys {
+		this.present[k] = true
+	}
+	return nil
+}
+
+// 按字段顺序输出非零值及配置文件中出现过的key，保存和复制时不丢掉显式配置的false、0
+func (this ConfigOption) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	t, v := reflect.TypeOf(this), reflect.ValueOf(this)
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := jsonName(t.Field(i))
+		if !ok || (v.Field(i).IsZero() && !this.present[name]) {
+			continue
+		}
+		value, err := json.Marshal(v.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(name))
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// 依次叠加默认值、配置文件、环境变量、命令行参数，得到实际生效的配置
+func (this ConfigOption) effective() (ConfigOption, error) {
+	ret := defaultOption()
+	t := reflect.TypeOf(ret)
+	dst, src := reflect.ValueOf(&ret).Elem(), reflect.ValueOf(this)
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := jsonName(t.Field(i))
+		if !ok {
+			continue
+		}
+		if this.present[name] || !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+		if v, ok := os.LookupEnv(optionEnvName(name)); ok {
+			if err := setOptionField(dst.Field(i), v); err != nil {
+				return ret, fmt.Errorf("%s: %v", optionEnvName(name), err)
+			}
+		}
+		if v, ok := optionFlags[name]; ok {
+			if err := setOptionField(dst.Field(i), v); err != nil {
+				return ret, fmt.Errorf("-%s: %v", name, err)
+			}
+		}
+	}
+	if ret.BufferSize <= 0 || ret.PollInterval <= 0 { //环境变量和命令行参数不经过配置校验
+		return ret, fmt.Errorf("bufferSize and pollInterval must be greater than 0")
+	}
+	return ret, nil
+}
+
+func setOptionField(f reflect.Value, v string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(v)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	}
+	return nil
+}
+
+func (this ConfigOption) GetReadTimeout() time.Duration {
+	return time.Duration(this.ReadTimeout) * time.Second
+}
+
+func (this ConfigOption) GetWriteTimeout() time.Duration {
+	return time.Duration(this.WriteTimeout) * time.Second
+}
+
+func (this ConfigOption) GetIdleTimeout() time.Duration {
+	return time.Duration(this.IdleTimeout) * time.Second
+}
+
+func (this ConfigOption) GetUpstreamTimeout() time.Duration {
+	return time.Duration(this.UpstreamTimeout) * time.Second
+}
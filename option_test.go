@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOptionEffective(t *testing.T) {
+	c := NewConfig("")
+	data := `{"defaultOption": {"port": 9000, "writeTimeout": 0, "h2c": false}}`
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		t.Fatal(err)
+	}
+	next := c.Clone() //复制和保存都经过json，出现过的0不能丢
+	for _, v := range []*Config{c, next} {
+		option, err := v.Default.effective()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if option.Port != 9000 || option.WriteTimeout != 0 || option.ReadTimeout != defaultOption().ReadTimeout {
+			t.Errorf("effective option %+v", option)
+		}
+	}
+
+	t.Setenv("ABTEST_READ_TIMEOUT", "0")
+	option, err := next.Default.effective()
+	if err != nil || option.ReadTimeout != 0 {
+		t.Errorf("env override: %+v, %v", option, err)
+	}
+	t.Setenv("ABTEST_BUFFER_SIZE", "0")
+	if _, err := next.Default.effective(); err == nil {
+		t.Error("expect an error for bufferSize 0")
+	}
+}
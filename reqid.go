@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const traceparentHeader = "traceparent"
+
+// UUIDv7：前48位为毫秒时间戳，其余为随机数，按时间有序；math/rand/v2的全局函数不加锁
+func newUUID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(time.Now().UnixMilli())<<16|rand.Uint64()&0xfff)
+	binary.BigEndian.PutUint64(b[8:16], rand.Uint64())
+	b[6] = b[6]&0x0f | 0x70 //版本7
+	b[8] = b[8]&0x3f | 0x80 //RFC 4122变体
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf[:])
+}
+
+// W3C trace context：version-traceid(32位hex)-parentid(16位hex)-flags
+type traceParent struct {
+	TraceId  string
+	ParentId string
+	Flags    string
+}
+
+func isHex(v string) bool {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTraceparent(v string) (traceParent, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || !isHex(parts[0]) || parts[0] == "ff" {
+		return traceParent{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceParent{}, false
+	}
+	t := traceParent{parts[1], parts[2], parts[3]}
+	if len(t.TraceId) != 32 || !isHex(t.TraceId) || t.TraceId == strings.Repeat("0", 32) {
+		return traceParent{}, false
+	}
+	if len(t.ParentId) != 16 || !isHex(t.ParentId) || t.ParentId == strings.Repeat("0", 16) {
+		return traceParent{}, false
+	}
+	if len(t.Flags) != 2 || !isHex(t.Flags) {
+		return traceParent{}, false
+	}
+	return t, true
+}
+
+func (this traceParent) String() string {
+	return "00-" + this.TraceId + "-" + this.ParentId + "-" + this.Flags
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for i := 0; i < n; i += 8 {
+		var tmp [8]byte
+		binary.BigEndian.PutUint64(tmp[:], rand.Uint64())
+		copy(b[i:], tmp[:])
+	}
+	return hex.EncodeToString(b)
+}
+
+// 客户端传来的请求id只接受可见字符，避免写入日志和请求头时被注入
+func validRequestId(v string) bool {
+	if v == "" || len(v) > 128 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] <= ' ' || v[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// uuid格式的请求id直接作为trace id，否则随机生成
+func traceIdOf(id string) string {
+	if tmp := strings.ToLower(strings.ReplaceAll(id, "-", "")); len(tmp) == 32 && isHex(tmp) && tmp != strings.Repeat("0", 32) {
+		return tmp
+	}
+	return randomHex(16)
+}
+
+// 请求id：优先用客户端传来的，其次用traceparent的trace id，都没有时生成UUIDv7；
+// 没有合法的traceparent时生成一个，trace id尽量和请求id一致，便于在日志和链路中对应；第三个返回值表示traceparent是否来自客户端
+func requestIds(c *Config, r *http.Request) (string, traceParent, bool) {
+	id := r.Header.Get(c.Option.RequestIdHeader)
+	if !validRequestId(id) {
+		id = ""
+	}
+	trace, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+	if id == "" {
+		if ok {
+			id = trace.TraceId
+		} else {
+			id = newUUID()
+		}
+	}
+	if !ok {
+		trace = traceParent{traceIdOf(id), randomHex(8), "00"} //采样时转发给上游的traceparent由requestTrace生成，标记为01
+	}
+	return id, trace, ok
+}
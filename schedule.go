@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// 每天生效的时间段，如{"start":"09:00","end":"18:00"}，start大于end时跨过零点
+type ConfigWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// 实验的生效时间，解析后的结果
+type ruleSchedule struct {
+	StartAt  time.Time
+	EndAt    time.Time
+	Windows  [][2]int //一天中的分钟数
+	Location *time.Location
+}
+
+const (
+	ruleActive      = "active"
+	rulePaused      = "paused"
+	ruleUpcoming    = "upcoming"
+	ruleExpired     = "expired"
+	ruleOutOfWindow = "outOfWindow"
+)
+
+// 支持RFC3339，或者按timeZone解析的"2006-01-02 15:04:05"
+func parseScheduleTime(v string, loc *time.Location) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateTime, v, loc)
+}
+
+// "09:30" -> 570
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expect HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseSchedule(rule ConfigRule) (*ruleSchedule, error) {
+	if rule.StartAt == "" && rule.EndAt == "" && len(rule.Windows) == 0 {
+		return nil, nil
+	}
+	loc := time.Local
+	if rule.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(rule.TimeZone); err != nil {
+			return nil, err
+		}
+	}
+	ret := &ruleSchedule{Location: loc}
+	var err error
+	if ret.StartAt, err = parseScheduleTime(rule.StartAt, loc); err != nil {
+		return nil, fmt.Errorf("startAt: %v", err)
+	}
+	if ret.EndAt, err = parseScheduleTime(rule.EndAt, loc); err != nil {
+		return nil, fmt.Errorf("endAt: %v", err)
+	}
+	if !ret.StartAt.IsZero() && !ret.EndAt.IsZero() && !ret.EndAt.After(ret.StartAt) {
+		return nil, fmt.Errorf("endAt must be after startAt")
+	}
+	for _, v := range rule.Windows {
+		start, err := parseClock(v.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(v.End)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("window %s-%s is empty", v.Start, v.End)
+		}
+		ret.Windows = append(ret.Windows, [2]int{start, end})
+	}
+	return ret, nil
+}
+
+// 当前时间实验所处的状态，nil表示一直生效
+func (this *ruleSchedule) State(now time.Time) string {
+	if this == nil {
+		return ruleActive
+	}
+	if !this.StartAt.IsZero() && now.Before(this.StartAt) {
+		return ruleUpcoming
+	}
+	if !this.EndAt.IsZero() && !now.Before(this.EndAt) {
+		return ruleExpired
+	}
+	if len(this.Windows) == 0 {
+		return ruleActive
+	}
+	local := now.In(this.Location)
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range this.Windows {
+		if w[0] <= w[1] && minute >= w[0] && minute < w[1] {
+			return ruleActive
+		}
+		if w[0] > w[1] && (minute >= w[0] || minute < w[1]) { //跨零点
+			return ruleActive
+		}
+	}
+	return ruleOutOfWindow
+}
+
+// 生成各rule的生效时间，格式错误时只记录日志，该rule按一直生效处理，配置校验会报告具体位置
+func (this *Config) buildSchedules() {
+	for k, v := range this.Rule {
+		tmp, ok := this.RuleOK[k]
+		if !ok {
+			continue
+		}
+		schedule, err := parseSchedule(v)
+		if err != nil {
+			log.Println("parse schedule error:", k, err)
+		}
+		tmp.Schedule = schedule
+	}
+}
+
+// 实验当前的状态：暂停、未开始、已结束、不在每天的时间段内或生效中
+func (this *Config) RuleState(host string, now time.Time) string {
+	if this.IsPaused(host) {
+		return rulePaused
+	}
+	if v, ok := this.RuleOK[host]; ok {
+		return v.Schedule.State(now)
+	}
+	return ruleActive
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 配置来源：本地文件或远程http，Watch在配置可能变化时调用changed，由调用方防抖后重新加载
+type ConfigSource interface {
+	Load() (*configFiles, error)
+	Watch(changed func()) error
+	String() string
+}
+
+// 当前进程的配置来源，-c为http(s)地址时从远程拉取
+var confSource ConfigSource
+
+func newConfigSource(filePath string) ConfigSource {
+	if isRemoteConfig(filePath) {
+		return newHttpSource(filePath)
+	}
+	return newFileSource(filePath)
+}
+
+func isRemoteConfig(filePath string) bool {
+	return strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://")
+}
+
+// 监听配置来源，变化后防抖、校验并重新加载；远程配置总是轮询
+func startWatcher() {
+	events := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	if err := confSource.Watch(changed); err != nil {
+		mylogger.Println("config watcher:", confSource, err)
+		return
+	}
+
+	go func() {
+		for range events {
+			timer := time.NewTimer(watchDebounce)
+			for waiting := true; waiting; {
+				select {
+				case <-events:
+					timer.Reset(watchDebounce)
+				case <-timer.C:
+					waiting = false
+				}
+			}
+			reloadConfig("watch")
+		}
+	}()
+}
+
+// 轮询http地址，用ETag避免重复下载，多个实例最终加载同一版本
+type httpSource struct {
+	url    string
+	client *http.Client
+	lock   sync.Mutex
+	etag   string
+	last   *configFiles
+}
+
+func newHttpSource(url string) *httpSource {
+	return &httpSource{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (this *httpSource) String() string {
+	return this.url
+}
+
+func (this *httpSource) Load() (*configFiles, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, this.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if this.etag != "" && this.last != nil {
+		req.Header.Set("If-None-Match", this.etag)
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && this.last != nil {
+		return this.last, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", this.url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	files, err := decodeRemoteConfig(this.url, resp.Header.Get("Content-Type"), data)
+	if err != nil {
+		return nil, err
+	}
+	this.etag, this.last = resp.Header.Get("ETag"), files
+	return files, nil
+}
+
+// 按Content-Type或地址的扩展名解析，远程配置不支持include
+func decodeRemoteConfig(rawURL, contentType string, data []byte) (*configFiles, error) {
+	ret := &configFiles{Data: data, Files: []string{rawURL}, RuleFile: make(map[string]string)}
+	fileName := "config.json"
+	if u, err := url.Parse(rawURL); err == nil && path.Ext(u.Path) != "" {
+		fileName = path.Base(u.Path)
+	}
+	switch {
+	case strings.Contains(contentType, "yaml"):
+		fileName = "config.yaml"
+	case strings.Contains(contentType, "toml"):
+		fileName = "config.toml"
+	case strings.Contains(contentType, "json"):
+		fileName = "config.json"
+	}
+	main, pos, err := decodeConfigFile(fileName, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rawURL, err)
+	}
+	if _, ok := main["include"]; ok {
+		return nil, fmt.Errorf("%s: include is not supported in remote config", rawURL)
+	}
+	if !strings.HasSuffix(fileName, ".json") {
+		ret.Merged, ret.Pos = true, pos
+		for k, v := range pos {
+			v.File = rawURL
+			pos[k] = v
+		}
+		if ret.Data, err = json.Marshal(main); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// 按defaultOption.pollInterval轮询，内容有变化时通知
+func (this *httpSource) Watch(changed func()) error {
+	go func() {
+		version := ""
+		if this.last != nil {
+			version = this.last.Version()
+		}
+		for {
+			time.Sleep(time.Duration(conf.Load().Option.PollInterval) * time.Second)
+			files, err := this.Load()
+			if err != nil {
+				mylogger.Println("poll config error:", err)
+				continue
+			}
+			if v := files.Version(); v != version {
+				version = v
+				changed()
+			}
+		}
+	}()
+	log.Println("polling config from", this.url)
+	return nil
+}
+
+// 测试或小规模部署时代替配置中心：把本地配置(合并include后)以json提供给其它实例，ETag为配置版本
+func configServe(args []string) int {
+	fs := flag.NewFlagSet("config serve", flag.ContinueOnError)
+	fileName := fs.String("c", "./config.json", "config file to serve")
+	addr := fs.String("addr", ":8090", "listen address")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	source := newFileSource(*fileName)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		files, err := source.Load()
+		if err == nil && len(files.Include) > 0 { //rule已经合并，去掉include
+			files, err = withoutInclude(files)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		etag := `"` + files.Version() + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(files.Data))
+	}
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", *fileName, *addr)
+	if err := http.ListenAndServe(*addr, http.HandlerFunc(handler)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func withoutInclude(files *configFiles) (*configFiles, error) {
+	var main map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(files.Data))
+	dec.UseNumber()
+	if err := dec.Decode(&main); err != nil {
+		return nil, err
+	}
+	delete(main, "include")
+	data, err := json.Marshal(main)
+	if err != nil {
+		return nil, err
+	}
+	ret := *files
+	ret.Data, ret.Include = data, nil
+	return &ret, nil
+}
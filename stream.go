@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 是否为SSE这类需要边读边写的流式响应
+func isStreamResponse(resp *http.Response) bool {
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return ct == "text/event-stream"
+}
+
+// 响应体的刷新间隔，SSE和grpc总是立即刷新，其余按配置，0表示不主动刷新
+func responseFlushInterval(c *Config, host string, resp *http.Response) time.Duration {
+	if isStreamResponse(resp) || isGrpc(resp.Header) {
+		return -1
+	}
+	return c.GetFlushInterval(host)
+}
+
+// 把上游响应体拷贝给客户端
+func copyResponse(w http.ResponseWriter, src io.Reader, flushInterval time.Duration) error {
+	var dst io.Writer = w
+	if flushInterval != 0 {
+		mlw := &maxLatencyWriter{
+			dst:     w,
+			rc:      http.NewResponseController(w),
+			latency: flushInterval,
+		}
+		defer mlw.stop()
+		dst = mlw
+	}
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	_, err := io.CopyBuffer(dst, src, buffer)
+	return err
+}
+
+// 写入后最多延迟latency就刷新一次，latency小于0时每次写入都刷新
+type maxLatencyWriter struct {
+	dst     io.Writer
+	rc      *http.ResponseController
+	latency time.Duration
+
+	mu           sync.Mutex
+	t            *time.Timer
+	flushPending bool
+}
+
+func (this *maxLatencyWriter) Write(p []byte) (n int, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	n, err = this.dst.Write(p)
+	if this.latency < 0 {
+		this.rc.Flush()
+		return
+	}
+	if this.flushPending {
+		return
+	}
+	if this.t == nil {
+		this.t = time.AfterFunc(this.latency, this.delayedFlush)
+	} else {
+		this.t.Reset(this.latency)
+	}
+	this.flushPending = true
+	return
+}
+
+func (this *maxLatencyWriter) delayedFlush() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.flushPending { // 已经被stop
+		return
+	}
+	this.rc.Flush()
+	this.flushPending = false
+}
+
+func (this *maxLatencyWriter) stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.flushPending = false
+	if this.t != nil {
+		this.t.Stop()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// 数值范围条件：min<=v<=max；mod>0时比较的是v%mod，用于按uid分桶，如{"mod":100,"min":0,"max":9}为10%的用户
+type ConfigRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+	Mod int64 `json:"mod,omitempty"`
+}
+
+func (this ConfigRange) Match(v int64) bool {
+	if this.Mod > 0 {
+		if v %= this.Mod; v < 0 {
+			v += this.Mod
+		}
+	}
+	return v >= this.Min && v <= this.Max
+}
+
+// 满足任意一个范围即可
+func matchRanges(ranges []ConfigRange, v int64) bool {
+	for _, r := range ranges {
+		if r.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析ip或cidr列表，单个ip按/32或/128处理
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, prefix.Masked())
+	}
+	return ret, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, v := range prefixes {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端ip：直连地址是trustedProxies中的代理时，从右往左取X-Forwarded-For中第一个不受信任的地址
+func clientAddr(c *Config, r *http.Request) netip.Addr {
+	addr := peerAddr(r)
+	trusted := c.TrustedNets
+	if !containsAddr(trusted, addr) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		v, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = v.Unmap()
+		if !containsAddr(trusted, addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// 生成查询用的ip段，出错时只记录日志，配置校验会报告具体位置
+func (this *Config) buildNets() {
+	nets, err := parsePrefixes(this.TrustedProxies)
+	if err != nil {
+		log.Println("parse trustedProxies error:", err)
+	}
+	this.TrustedNets = nets
+	for k, v := range this.Rule {
+		if tmp, ok := this.RuleOK[k]; ok {
+			if tmp.ClientIP, err = parsePrefixes(v.ClientIPs); err != nil {
+				log.Println("parse clientIPs error:", k, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var (
+	tlsServer   *http.Server
+	tlsListener net.Listener
+)
+
+// 启动https监听，证书按SNI从当前配置中选择，随配置一起热加载
+func startTLS() {
+	port := conf.Load().GetTLSPort()
+	if port <= 0 {
+		return
+	}
+
+	tlsServer = &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+		IdleTimeout:  server.IdleTimeout,
+		Handler:      server.Handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return conf.Load().GetCertificate(hello)
+			},
+		},
+		Protocols: new(http.Protocols),
+	}
+	tlsServer.Protocols.SetHTTP1(true)
+	tlsServer.Protocols.SetHTTP2(true)
+
+	var err error
+	tlsListener, err = listen("https", "tcp", tlsServer.Addr)
+	if err != nil {
+		mylogger.Fatalf("tls listener error: %v\n", err)
+		return
+	}
+
+	go func() {
+		err := tlsServer.ServeTLS(tlsListener, "", "")
+		if err != nil {
+			if err == http.ErrServerClosed {
+				log.Printf("TLS server closed under request(%s)\n", err)
+			} else {
+				log.Printf("TLS server closed unexpected(%s)\n", err)
+			}
+		}
+	}()
+	log.Printf("Starting httpsServer pid:%d, port:%d\n", os.Getpid(), port)
+}
+
+// http请求跳转到https的同一地址
+func redirectHttps(c *Config, w http.ResponseWriter, r *http.Request) {
+	host := stripPort(r.Host)
+	if port := c.GetTLSPort(); port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	u := *r.URL
+	u.Scheme = "https"
+	u.Host = host
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead { //保持请求方法和body
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u.String(), code)
+}
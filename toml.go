@@ -0,0 +1,426 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 只支持配置文件用到的toml子集：[table]、[[array]]、key = value、点分key、字符串、数字、布尔、数组(可跨行)、行内表，不支持多行字符串
+
+type tomlParser struct {
+	text string
+	pos  int
+	line int
+	keys map[string]configPos //key、表头和数组元素所在的行列
+}
+
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	ret, _, err := parseTOMLPositions(data)
+	return ret, err
+}
+
+func parseTOMLPositions(data []byte) (map[string]interface{}, map[string]configPos, error) {
+	p := &tomlParser{text: string(data), line: 1, keys: make(map[string]configPos)}
+	root := make(map[string]interface{})
+	current, path := root, ""
+	for {
+		p.skipBlank(true)
+		if p.pos >= len(p.text) {
+			return root, p.keys, nil
+		}
+		var err error
+		if p.text[p.pos] == '[' {
+			current, path, err = p.table(root)
+		} else {
+			err = p.keyValue(current, path)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", p.line, err)
+		}
+		p.skipBlank(false)
+		if p.pos < len(p.text) && p.text[p.pos] != '\n' {
+			return nil, nil, fmt.Errorf("line %d: unexpected %q", p.line, p.rest())
+		}
+	}
+}
+
+// 当前位置的行列
+func (this *tomlParser) position() configPos {
+	return configPos{Line: this.line, Col: this.pos - strings.LastIndexByte(this.text[:this.pos], '\n')}
+}
+
+// 没有记录过的key才记录，[a.b]和a.c = 1中的a记在第一次出现的地方
+func (this *tomlParser) mark(path string, pos configPos) {
+	if _, ok := this.keys[path]; !ok {
+		this.keys[path] = pos
+	}
+}
+
+func (this *tomlParser) rest() string {
+	end := strings.IndexByte(this.text[this.pos:], '\n')
+	if end < 0 {
+		return this.text[this.pos:]
+	}
+	return this.text[this.pos : this.pos+end]
+}
+
+// 跳过空白和注释，newline为true时同时跳过换行
+func (this *tomlParser) skipBlank(newline bool) {
+	for this.pos < len(this.text) {
+		switch c := this.text[this.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			this.pos++
+		case c == '#':
+			for this.pos < len(this.text) && this.text[this.pos] != '\n' {
+				this.pos++
+			}
+		case c == '\n' && newline:
+			this.pos++
+			this.line++
+		default:
+			return
+		}
+	}
+}
+
+// [a.b] 或 [[a.b]]，返回之后的key/value写入的表及其路径
+func (this *tomlParser) table(root map[string]interface{}) (map[string]interface{}, string, error) {
+	pos := this.position()
+	array := strings.HasPrefix(this.text[this.pos:], "[[")
+	if array {
+		this.pos += 2
+	} else {
+		this.pos++
+	}
+	keys, err := this.keyPath()
+	if err != nil {
+		return nil, "", err
+	}
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	this.skipBlank(false)
+	if !strings.HasPrefix(this.text[this.pos:], closing) {
+		return nil, "", fmt.Errorf("expect %s", closing)
+	}
+	this.pos += len(closing)
+
+	parent, path, err := this.descend(root, "", keys[:len(keys)-1], pos)
+	if err != nil {
+		return nil, "", err
+	}
+	last := keys[len(keys)-1]
+	path = configKey(path, last)
+	this.mark(path, pos)
+	if array {
+		list, _ := parent[last].([]interface{})
+		if _, ok := parent[last]; ok && list == nil {
+			return nil, "", fmt.Errorf("key %q is not an array of tables", last)
+		}
+		table := make(map[string]interface{})
+		parent[last] = append(list, table)
+		path = configKey(path, strconv.Itoa(len(list)))
+		this.mark(path, pos)
+		return table, path, nil
+	}
+	switch v := parent[last].(type) {
+	case nil:
+		table := make(map[string]interface{})
+		parent[last] = table
+		return table, path, nil
+	case map[string]interface{}:
+		return v, path, nil
+	}
+	return nil, "", fmt.Errorf("key %q is already defined", last)
+}
+
+// 按点分key逐级找到(或创建)表，数组表取最后一个元素
+func (this *tomlParser) descend(table map[string]interface{}, path string, keys []string, pos configPos) (map[string]interface{}, string, error) {
+	for _, k := range keys {
+		path = configKey(path, k)
+		this.mark(path, pos)
+		switch v := table[k].(type) {
+		case nil:
+			next := make(map[string]interface{})
+			table[k] = next
+			table = next
+		case map[string]interface{}:
+			table = v
+		case []interface{}:
+			if len(v) == 0 { //如x = []，不能再定义[x.y]
+				return nil, "", fmt.Errorf("key %q is not a table", k)
+			}
+			last, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, "", fmt.Errorf("key %q is not a table", k)
+			}
+			table = last
+			path = configKey(path, strconv.Itoa(len(v)-1))
+		default:
+			return nil, "", fmt.Errorf("key %q is not a table", k)
+		}
+	}
+	return table, path, nil
+}
+
+func (this *tomlParser) keyPath() ([]string, error) {
+	keys := make([]string, 0, 2)
+	for {
+		this.skipBlank(false)
+		if this.pos >= len(this.text) {
+			return nil, fmt.Errorf("expect key")
+		}
+		var key string
+		switch this.text[this.pos] {
+		case '"', '\'':
+			v, err := this.str()
+			if err != nil {
+				return nil, err
+			}
+			key = v
+		default:
+			start := this.pos
+			for this.pos < len(this.text) && isTOMLBareKey(this.text[this.pos]) {
+				this.pos++
+			}
+			if start == this.pos {
+				return nil, fmt.Errorf("expect key")
+			}
+			key = this.text[start:this.pos]
+		}
+		keys = append(keys, key)
+		this.skipBlank(false)
+		if this.pos >= len(this.text) || this.text[this.pos] != '.' {
+			return keys, nil
+		}
+		this.pos++
+	}
+}
+
+func isTOMLBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (this *tomlParser) keyValue(table map[string]interface{}, path string) error {
+	this.skipBlank(false)
+	pos := this.position()
+	keys, err := this.keyPath()
+	if err != nil {
+		return err
+	}
+	if this.pos >= len(this.text) || this.text[this.pos] != '=' {
+		return fmt.Errorf("expect '=' after key")
+	}
+	this.pos++
+	parent, path, err := this.descend(table, path, keys[:len(keys)-1], pos)
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := parent[last]; ok {
+		return fmt.Errorf("duplicate key %q", last)
+	}
+	path = configKey(path, last)
+	this.mark(path, pos)
+	v, err := this.value(path)
+	if err != nil {
+		return err
+	}
+	parent[last] = v
+	return nil
+}
+
+func (this *tomlParser) str() (string, error) {
+	quote := this.text[this.pos]
+	if strings.HasPrefix(this.text[this.pos:], strings.Repeat(string(quote), 3)) {
+		return "", fmt.Errorf("multi-line strings are not supported")
+	}
+	end := this.pos + 1
+	for ; end < len(this.text) && this.text[end] != quote && this.text[end] != '\n'; end++ {
+		if quote == '"' && this.text[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(this.text) || this.text[end] != quote {
+		return "", fmt.Errorf("unterminated string")
+	}
+	raw := this.text[this.pos : end+1]
+	this.pos = end + 1
+	if quote == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+	return strconv.Unquote(raw)
+}
+
+func (this *tomlParser) value(path string) (interface{}, error) {
+	this.skipBlank(false)
+	if this.pos >= len(this.text) {
+		return nil, fmt.Errorf("expect value")
+	}
+	switch c := this.text[this.pos]; c {
+	case '"', '\'':
+		return this.str()
+	case '[':
+		this.pos++
+		ret := make([]interface{}, 0)
+		for {
+			this.skipBlank(true)
+			if this.pos < len(this.text) && this.text[this.pos] == ']' {
+				this.pos++
+				return ret, nil
+			}
+			sub := configKey(path, strconv.Itoa(len(ret)))
+			this.mark(sub, this.position())
+			v, err := this.value(sub)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+			this.skipBlank(true)
+			if this.pos < len(this.text) && this.text[this.pos] == ',' {
+				this.pos++
+			} else if this.pos >= len(this.text) || this.text[this.pos] != ']' {
+				return nil, fmt.Errorf("expect ',' or ']' in array")
+			}
+		}
+	case '{':
+		this.pos++
+		ret := make(map[string]interface{})
+		for {
+			this.skipBlank(false)
+			if this.pos < len(this.text) && this.text[this.pos] == '}' {
+				this.pos++
+				return ret, nil
+			}
+			if err := this.keyValue(ret, path); err != nil {
+				return nil, err
+			}
+			this.skipBlank(false)
+			if this.pos < len(this.text) && this.text[this.pos] == ',' {
+				this.pos++
+			} else if this.pos >= len(this.text) || this.text[this.pos] != '}' {
+				return nil, fmt.Errorf("expect ',' or '}' in inline table")
+			}
+		}
+	}
+
+	start := this.pos
+	for this.pos < len(this.text) && !strings.ContainsRune(" \t\r\n,]}#", rune(this.text[this.pos])) {
+		this.pos++
+	}
+	raw := this.text[start:this.pos]
+	switch raw {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "":
+		return nil, fmt.Errorf("expect value")
+	}
+	num := strings.ReplaceAll(raw, "_", "")
+	if n, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	if raw[0] >= '0' && raw[0] <= '9' { //日期时间按字符串处理
+		return raw, nil
+	}
+	return nil, fmt.Errorf("invalid value %q", raw)
+}
+
+// 输出toml，普通值在前，子表用[a.b]，元素全是表的数组用[[a.b]]
+func encodeTOML(v map[string]interface{}) []byte {
+	var b strings.Builder
+	writeTOMLTable(&b, v, nil)
+	return []byte(strings.TrimLeft(b.String(), "\n"))
+}
+
+func tomlKey(k string) string {
+	if k != "" && strings.IndexFunc(k, func(r rune) bool { return r > 127 || !isTOMLBareKey(byte(r)) }) < 0 {
+		return k
+	}
+	return strconv.Quote(k)
+}
+
+func tomlValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				items = append(items, tomlValue(item))
+			}
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		keys := sortedKeys(v)
+		items := make([]string, 0, len(keys))
+		for _, k := range keys {
+			if v[k] != nil {
+				items = append(items, tomlKey(k)+" = "+tomlValue(v[k]))
+			}
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+func isTOMLTableArray(v interface{}) bool {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+	for _, item := range list {
+		if _, ok := item.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeTOMLTable(b *strings.Builder, table map[string]interface{}, path []string) {
+	keys := sortedKeys(table)
+	for _, k := range keys {
+		v := table[k]
+		if _, ok := v.(map[string]interface{}); ok || v == nil || isTOMLTableArray(v) {
+			continue
+		}
+		fmt.Fprintf(b, "%s = %s\n", tomlKey(k), tomlValue(v))
+	}
+	for _, k := range keys {
+		sub := make([]string, len(path)+1)
+		for i, p := range path {
+			sub[i] = tomlKey(p)
+		}
+		sub[len(path)] = tomlKey(k)
+		switch v := table[k].(type) {
+		case map[string]interface{}:
+			fmt.Fprintf(b, "\n[%s]\n", strings.Join(sub, "."))
+			writeTOMLTable(b, v, append(path[:len(path):len(path)], k))
+		case []interface{}:
+			if !isTOMLTableArray(v) {
+				continue
+			}
+			for _, item := range v {
+				fmt.Fprintf(b, "\n[[%s]]\n", strings.Join(sub, "."))
+				writeTOMLTable(b, item.(map[string]interface{}), append(path[:len(path):len(path)], k))
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTOMLRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		v    map[string]interface{}
+	}{
+		{"scalars", map[string]interface{}{"s": "a = \"b\" # c", "i": int64(-3), "f": 1.5, "b": true, "empty": ""}},
+		{"quoted key", map[string]interface{}{"a.b": "x", "中文": "y"}},
+		{"nested table", map[string]interface{}{"rule": map[string]interface{}{"a.com": map[string]interface{}{"groupA": "http://a", "percent": int64(50)}}}},
+		{"array of tables", map[string]interface{}{"list": []interface{}{map[string]interface{}{"a": int64(1)}, map[string]interface{}{"b": []interface{}{"x", "y"}}}}},
+		{"empty", map[string]interface{}{"m": map[string]interface{}{}, "l": []interface{}{}}},
+		{"inline table in array", map[string]interface{}{"l": []interface{}{map[string]interface{}{"k": "v"}, "s"}}},
+	}
+	for _, c := range cases {
+		data := encodeTOML(c.v)
+		got, err := parseTOML(data)
+		if err != nil {
+			t.Errorf("%s: parse %q: %v", c.name, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.v) {
+			t.Errorf("%s: round trip %q\ngot  %#v\nwant %#v", c.name, data, got, c.v)
+		}
+	}
+}
+
+func TestTOMLParseError(t *testing.T) {
+	cases := []struct {
+		name, text, err string
+	}{
+		{"empty array then table", "x = []\n[x.y]\n", `key "x" is not a table`},
+		{"empty array then dotted key", "x = []\nx.y = 1\n", `key "x" is not a table`},
+		{"scalar then table", "x = 1\n[x.y]\n", `key "x" is not a table`},
+		{"table then array of tables", "[x]\n[[x]]\n", `key "x" is not an array of tables`},
+		{"duplicate key", "a = 1\na = 2\n", `duplicate key "a"`},
+		{"redefined table", "a = 1\n[a]\n", `key "a" is already defined`},
+		{"unterminated string", "a = \"b\n", "unterminated string"},
+		{"multi-line string", "a = \"\"\"b\"\"\"\n", "not supported"},
+	}
+	for _, c := range cases {
+		_, err := parseTOML([]byte(c.text))
+		if err == nil {
+			t.Errorf("%s: expect error for %q", c.name, c.text)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %q, expect %q", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 链路追踪，span按OTLP/HTTP JSON格式批量发送到collector
+type ConfigTracing struct {
+	Endpoint      string            `json:"endpoint"`                //如http://127.0.0.1:4318/v1/traces
+	ServiceName   string            `json:"serviceName,omitempty"`   //默认abtest
+	SampleRate    float64           `json:"sampleRate,omitempty"`    //没有上游traceparent时的采样率，0或不配置为全部采样；有时沿用上游的采样标记
+	Headers       map[string]string `json:"headers,omitempty"`       //发送时附加的请求头，如鉴权
+	BatchSize     int               `json:"batchSize,omitempty"`     //默认512
+	FlushInterval int64             `json:"flushInterval,omitempty"` //毫秒，默认2000
+}
+
+// OTLP中span的类型
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+const spanQueueSize = 4096
+
+type span struct {
+	TraceId  string
+	SpanId   string
+	ParentId string
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Err      string
+}
+
+func (this *span) Set(key, value string) {
+	if this != nil {
+		this.Attrs[key] = value
+	}
+}
+
+func (this *span) Fail(err error) {
+	if this != nil && err != nil {
+		this.Err = err.Error()
+	}
+}
+
+func (this *span) Finish() {
+	if this != nil && this.End.IsZero() {
+		this.End = time.Now()
+	}
+}
+
+// 一个请求内的span，不采样时为nil，所有方法都可以直接调用
+type requestTrace struct {
+	TraceId string
+	Flags   string
+	spans   []*span
+}
+
+// 按上游的traceparent决定是否采样，incoming为false时traceparent是本地生成的
+func newRequestTrace(c *ConfigTracing, trace traceParent, incoming bool) *requestTrace {
+	if c == nil || c.Endpoint == "" {
+		return nil
+	}
+	if incoming {
+		if v, _ := strconv.ParseUint(trace.Flags, 16, 8); v&1 == 0 {
+			return nil
+		}
+	} else if c.SampleRate > 0 && rand.Float64() >= c.SampleRate {
+		return nil
+	}
+	return &requestTrace{TraceId: trace.TraceId, Flags: "01"}
+}
+
+func (this *requestTrace) Start(name string, kind int, parent *span) *span {
+	if this == nil {
+		return nil
+	}
+	s := &span{
+		TraceId: this.TraceId,
+		SpanId:  randomHex(8),
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+		Attrs:   make(map[string]string),
+	}
+	if parent != nil {
+		s.ParentId = parent.SpanId
+	}
+	this.spans = append(this.spans, s)
+	return s
+}
+
+// 已经发生过的一段，如__getIp中解密标识的耗时
+func (this *requestTrace) Record(name string, parent *span, start, end time.Time) {
+	if this == nil || start.IsZero() {
+		return
+	}
+	s := this.Start(name, spanInternal, parent)
+	s.Start, s.End = start, end
+}
+
+// 传给上游的traceparent，parent为发起请求的span
+func (this *requestTrace) Traceparent(parent *span) string {
+	return traceParent{this.TraceId, parent.SpanId, this.Flags}.String()
+}
+
+// 请求结束后把span交给发送队列，队列满时丢弃
+func (this *requestTrace) Export() {
+	if this == nil {
+		return
+	}
+	exporter.once.Do(func() {
+		go exporter.run()
+	})
+	for _, s := range this.spans {
+		s.Finish()
+		select {
+		case exporter.queue <- s:
+		default:
+			metrics.Inc("abtest_trace_spans_dropped_total")
+		}
+	}
+}
+
+type spanExporter struct {
+	once   sync.Once
+	queue  chan *span
+	client *http.Client
+}
+
+var exporter = &spanExporter{
+	queue:  make(chan *span, spanQueueSize),
+	client: &http.Client{Timeout: 5 * time.Second},
+}
+
+func (this *spanExporter) run() {
+	batch := make([]*span, 0, 512)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		c := conf.Load().Tracing
+		size, interval := 512, 2*time.Second
+		if c != nil && c.BatchSize > 0 {
+			size = c.BatchSize
+		}
+		if c != nil && c.FlushInterval > 0 {
+			interval = time.Duration(c.FlushInterval) * time.Millisecond
+		}
+		select {
+		case s := <-this.queue:
+			batch = append(batch, s)
+			if len(batch) < size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 || time.Since(last) < interval {
+				continue
+			}
+		}
+		if err := this.send(c, batch); err != nil {
+			mylogger.Println("export spans error:", err)
+			metrics.Inc("abtest_trace_export_errors_total")
+		}
+		batch = batch[:0]
+		last = time.Now()
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttrs(m map[string]string) []otlpAttr {
+	ret := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		ret = append(ret, otlpAttr{k, otlpValue{v}})
+	}
+	return ret
+}
+
+// OTLP/HTTP JSON，id为hex，时间为纳秒
+func (this *spanExporter) send(c *ConfigTracing, batch []*span) error {
+	if c == nil || c.Endpoint == "" { //配置重新加载后关闭了追踪
+		return nil
+	}
+	service := c.ServiceName
+	if service == "" {
+		service = "abtest"
+	}
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		item := map[string]interface{}{
+			"traceId":           s.TraceId,
+			"spanId":            s.SpanId,
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.Attrs),
+		}
+		if s.ParentId != "" {
+			item["parentSpanId"] = s.ParentId
+		}
+		if s.Err != "" {
+			item["status"] = map[string]interface{}{"code": 2, "message": s.Err}
+		}
+		spans = append(spans, item)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": otlpAttrs(map[string]string{"service.name": service})},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "abtest"}, "spans": spans}},
+		}},
+	})
+	req, err := http.NewRequest(http.MethodPost, c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", c.Endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector收到的span，字段名和OTLP JSON一致
+type testSpan struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Kind         int
+}
+
+type testCollector struct {
+	sync.Mutex
+	spans   []testSpan
+	service string
+	auth    string
+}
+
+func (this *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttr
+			}
+			ScopeSpans []struct {
+				Spans []testSpan
+			}
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.auth = r.Header.Get("Authorization")
+	for _, rs := range body.ResourceSpans {
+		for _, attr := range rs.Resource.Attributes {
+			if attr.Key == "service.name" {
+				this.service = attr.Value.StringValue
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			this.spans = append(this.spans, ss.Spans...)
+		}
+	}
+}
+
+// 等到收到某个trace的n个span，按名字返回
+func (this *testCollector) wait(t *testing.T, traceId string, n int) map[string]testSpan {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		this.Lock()
+		ret := make(map[string]testSpan)
+		for _, s := range this.spans {
+			if s.TraceId == traceId {
+				ret[s.Name] = s
+			}
+		}
+		this.Unlock()
+		if len(ret) >= n {
+			return ret
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("collector did not receive %d spans of trace %s", n, traceId)
+	return nil
+}
+
+func TestTracingExport(t *testing.T) {
+	collector := &testCollector{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	var upstreamMu sync.Mutex
+	var upstreamTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamMu.Lock()
+		upstreamTraceparent = r.Header.Get(traceparentHeader)
+		upstreamMu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	data, _ := json.Marshal(map[string]interface{}{
+		"log":           map[string]string{"dir": dir + "/", "format": "test.log"},
+		"defaultServer": map[string][]string{"groupA": {backend.Listener.Addr().String()}, "groupB": {backend.Listener.Addr().String()}},
+		"tracing": map[string]interface{}{
+			"endpoint":      collectorServer.URL + "/v1/traces",
+			"serviceName":   "abtest-test",
+			"headers":       map[string]string{"Authorization": "Bearer collector"},
+			"flushInterval": 10,
+		},
+		"rule": map[string]interface{}{},
+	})
+	fileName := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Store(c)
+	mylogger = NewLogger(c.GetLogDir(), c.GetLogFormat(), c.GetLogPrefix())
+
+	cases := []struct {
+		name        string
+		traceparent string //客户端传来的，为空时本地生成
+	}{
+		{"incoming", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{"local", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/path", nil) //和服务端收到的请求一样，URL只有路径
+		req.Host = "trace.example.com"
+		if tc.traceparent != "" {
+			req.Header.Set(traceparentHeader, tc.traceparent)
+		}
+		rec := httptest.NewRecorder()
+		proxy(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.name, rec.Code, rec.Body)
+		}
+
+		upstreamMu.Lock()
+		sent, ok := parseTraceparent(upstreamTraceparent)
+		upstreamMu.Unlock()
+		if !ok || sent.Flags != "01" {
+			t.Fatalf("%s: upstream got traceparent %q", tc.name, upstreamTraceparent)
+		}
+		requestId := rec.Header().Get(c.Option.RequestIdHeader)
+		if incoming, ok := parseTraceparent(tc.traceparent); ok {
+			if sent.TraceId != incoming.TraceId {
+				t.Errorf("%s: upstream trace id %s, expect %s", tc.name, sent.TraceId, incoming.TraceId)
+			}
+			if requestId != incoming.TraceId {
+				t.Errorf("%s: request id %s, expect the incoming trace id", tc.name, requestId)
+			}
+		} else if sent.TraceId != strings.ReplaceAll(requestId, "-", "") {
+			t.Errorf("%s: upstream trace id %s, expect request id %s", tc.name, sent.TraceId, requestId)
+		}
+
+		spans := collector.wait(t, sent.TraceId, 4)
+		root, ok := spans["proxy"]
+		if !ok || root.Kind != spanServer {
+			t.Fatalf("%s: no server span named proxy: %+v", tc.name, spans)
+		}
+		if incoming, ok := parseTraceparent(tc.traceparent); ok && root.ParentSpanId != incoming.ParentId {
+			t.Errorf("%s: proxy parent %s, expect %s", tc.name, root.ParentSpanId, incoming.ParentId)
+		} else if !ok && root.ParentSpanId != "" {
+			t.Errorf("%s: local root span has parent %s", tc.name, root.ParentSpanId)
+		}
+		for _, name := range []string{"parse", "select", "upstream"} {
+			if s, ok := spans[name]; !ok || s.ParentSpanId != root.SpanId {
+				t.Errorf("%s: span %s %+v, expect parent %s", tc.name, name, s, root.SpanId)
+			}
+		}
+		if s := spans["upstream"]; s.Kind != spanClient || s.SpanId != sent.ParentId {
+			t.Errorf("%s: upstream span %+v, backend saw parent %s", tc.name, s, sent.ParentId)
+		}
+	}
+
+	collector.Lock()
+	defer collector.Unlock()
+	if collector.service != "abtest-test" || collector.auth != "Bearer collector" {
+		t.Errorf("collector got service %q, authorization %q", collector.service, collector.auth)
+	}
+}
+
+// 没有开启链路追踪或没有采样时，本地生成的traceparent标记为不采样，客户端传来的原样转发
+func TestTraceparentNotSampled(t *testing.T) {
+	var upstreamMu sync.Mutex
+	var upstreamTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamMu.Lock()
+		upstreamTraceparent = r.Header.Get(traceparentHeader)
+		upstreamMu.Unlock()
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	cases := []struct {
+		name        string
+		tracing     map[string]interface{}
+		traceparent string
+		flags       string
+	}{
+		{"tracing off", nil, "", "00"},
+		{"not sampled", map[string]interface{}{"endpoint": "http://127.0.0.1:1/v1/traces", "sampleRate": 1e-9}, "", "00"},
+		{"incoming", nil, incoming, "01"},
+	}
+	for _, tc := range cases {
+		cfg := map[string]interface{}{
+			"log":           map[string]string{"dir": dir + "/", "format": "test.log"},
+			"defaultServer": map[string][]string{"groupA": {backend.Listener.Addr().String()}, "groupB": {backend.Listener.Addr().String()}},
+		}
+		if tc.tracing != nil {
+			cfg["tracing"] = tc.tracing
+		}
+		data, _ := json.Marshal(cfg)
+		fileName := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(fileName, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := LoadConfig(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.Store(c)
+		mylogger = NewLogger(c.GetLogDir(), c.GetLogFormat(), c.GetLogPrefix())
+
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.Host = "trace.example.com"
+		if tc.traceparent != "" {
+			req.Header.Set(traceparentHeader, tc.traceparent)
+		}
+		proxy(httptest.NewRecorder(), req)
+
+		upstreamMu.Lock()
+		sent, ok := parseTraceparent(upstreamTraceparent)
+		upstreamMu.Unlock()
+		if !ok || sent.Flags != tc.flags {
+			t.Errorf("%s: upstream got traceparent %q, expect flags %s", tc.name, upstreamTraceparent, tc.flags)
+		}
+		if tc.traceparent != "" && upstreamTraceparent != tc.traceparent {
+			t.Errorf("%s: upstream got traceparent %q, expect %q", tc.name, upstreamTraceparent, tc.traceparent)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const trackPath = "/abtest/track"
+
+// 转化上报的路径，没有配置events时也保留默认路径，返回404而不转发
+func (this *Config) GetTrackPath() string {
+	if this.Events != nil && this.Events.TrackPath != "" {
+		return this.Events.TrackPath
+	}
+	return trackPath
+}
+
+// 转化上报的路径随配置热加载变化，不能注册到mux上，每个请求按当前配置判断
+func route(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == conf.Load().GetTrackPath() {
+		track(w, r)
+		return
+	}
+	proxy(w, r)
+}
+
+// 转化事件，json请求体或表单/查询参数
+type trackRequest struct {
+	Goal    string  `json:"goal"`
+	Value   float64 `json:"value,omitempty"`
+	Visitor string  `json:"visitor,omitempty"` //默认取visitorCookie
+	Abd     string  `json:"abd,omitempty"`     //默认取请求头或cookie中的标识
+	Abv     string  `json:"abv,omitempty"`
+	Host    string  `json:"host,omitempty"` //实验的host，默认为请求的host
+}
+
+func parseTrackRequest(c *Config, w http.ResponseWriter, r *http.Request) (trackRequest, error) {
+	var req trackRequest
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method == http.MethodPost && ct == "application/json" {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			return req, err
+		}
+	} else {
+		req.Goal = r.FormValue("goal")
+		req.Visitor = r.FormValue("visitor")
+		req.Abd = r.FormValue("abd")
+		req.Abv = r.FormValue("abv")
+		req.Host = r.FormValue("host")
+		if v := r.FormValue("value"); v != "" {
+			var err error
+			if req.Value, err = strconv.ParseFloat(v, 64); err != nil {
+				return req, err
+			}
+		}
+	}
+	abv, abd := abParams(c, r)
+	if req.Abv == "" {
+		req.Abv = abv
+	}
+	if req.Abd == "" {
+		req.Abd = abd
+	}
+	if req.Visitor == "" {
+		if v, err := r.Cookie(c.Option.VisitorCookie); err == nil {
+			req.Visitor = v.Value
+		}
+	}
+	if req.Host == "" {
+		req.Host = ruleHost(c, r)
+	}
+	return req, nil
+}
+
+// 记录转化：按和转发请求相同的逻辑得到访客当前的分组及实验层，每个实验写一条conversion事件；
+// 没有配置events时返回404，不转发给后端，避免转化请求被后端当作普通请求处理
+func track(w http.ResponseWriter, r *http.Request) {
+	c := conf.Load() //解析请求和分流用同一份配置
+	if c.Events == nil {
+		http.Error(w, "conversion tracking is disabled: events are not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseTrackRequest(c, w, r)
+	if err == nil && req.Goal == "" {
+		err = errors.New("goal is required")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	host := req.Host
+	holdout := c.HoldoutOf(host, req.Visitor)
+	_, group, d := __getIp(c, host, req.Abv, req.Abd, clientAddr(c, r), holdout)
+
+	e := Event{Type: "conversion", Visitor: req.Visitor, Host: host, Experiment: host, Goal: req.Goal, Value: req.Value}
+	e.RequestId, _, _ = requestIds(c, r)
+	if len(d.Token) > 1 {
+		e.Uid = d.Token[1]
+	}
+	ret := make(map[string]string)
+	emit := func(experiment, variant string) {
+		e.Experiment, e.Variant = experiment, variant
+		ret[experiment] = variant
+		events.Emit(c.Events, e)
+	}
+	if variant := d.Variant(group); variant != "" {
+		emit(host, variant)
+		if rule := c.Rule[host]; variant != criterionHoldout && req.Visitor != "" && len(rule.Layers) > 0 {
+			for _, v := range assignLayers(rule.Layers, req.Visitor) {
+				if v.Holdout {
+					emit(v.Experiment, criterionHoldout)
+				} else {
+					emit(v.Experiment, v.Variant)
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"goal": req.Goal, "experiments": ret})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 转化上报的路径由代理处理，不转发给后端；不带goal的请求返回400，不会产生事件
+func TestTrackPath(t *testing.T) {
+	server := httptest.NewServer(&testBackend{})
+	defer server.Close()
+
+	cases := []struct {
+		name   string
+		events map[string]interface{}
+		path   string
+		want   int
+	}{
+		{"default path", map[string]interface{}{"output": "stdout"}, trackPath, http.StatusBadRequest},
+		{"custom path", map[string]interface{}{"output": "stdout", "trackPath": "/t"}, "/t", http.StatusBadRequest},
+		{"default path after change", map[string]interface{}{"output": "stdout", "trackPath": "/t"}, trackPath, http.StatusOK},
+		{"disabled", nil, trackPath, http.StatusNotFound},
+		{"disabled custom path", nil, "/t", http.StatusOK},
+	}
+	for _, tc := range cases {
+		cfg := map[string]interface{}{}
+		if tc.events != nil {
+			cfg["events"] = tc.events
+		}
+		testProxyConfig(t, server, cfg)
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Host = "track.example.com"
+		rec := httptest.NewRecorder()
+		route(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: %s got status %d, expect %d: %s", tc.name, tc.path, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
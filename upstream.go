@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	groupA = "groupA"
+	groupB = "groupB"
+)
+
+// 明文HTTP/2(h2c)与TLS配置无关，所有h2c上游共用
+var h2cTransport = newH2CTransport()
+
+type ConfigUpstream struct {
+	Scheme             string `json:"scheme"`     //组内地址不带scheme时使用，默认http，h2c表示明文HTTP/2
+	CA                 string `json:"ca"`         //校验上游证书的CA文件，为空使用系统CA
+	Cert               string `json:"cert"`       //mTLS客户端证书
+	Key                string `json:"key"`        //mTLS客户端私钥
+	ServerName         string `json:"serverName"` //SNI及证书校验使用的名字，默认取上游地址
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// 按上游配置创建的Transport，重新加载时Key没变的沿用旧的，保留连接池
+type hostTransport struct {
+	*http.Transport
+	Key string //上游配置及证书文件的修改时间和大小
+}
+
+// 上游地址可以是完整url(https://10.0.0.1:8443)，也可以是ip:port
+func parseUpstream(addr, scheme string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		if scheme == "" {
+			scheme = "http"
+		}
+		addr = scheme + "://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream %q has no host", addr)
+	}
+	return u, nil
+}
+
+func newUpstreamTransport(c *ConfigUpstream) (*http.Transport, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + c.CA)
+		}
+		tc.RootCAs = pool
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tc
+	return t, nil
+}
+
+func newH2CTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+func upstreamKey(c *ConfigUpstream) string {
+	key := fmt.Sprintf("%+v", *c)
+	for _, name := range []string{c.CA, c.Cert, c.Key} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			key += fmt.Sprintf("|%s:%d:%d", name, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return key
+}
+
+// 按上游配置创建Transport
+func (this *Config) loadTransports() {
+	transports := make(map[string]*hostTransport)
+	add := func(host string, upstream map[string]*ConfigUpstream) {
+		for group, c := range upstream {
+			if c == nil {
+				continue
+			}
+			t, err := newUpstreamTransport(c)
+			if err != nil {
+				log.Println("load upstream error:", host, group, err)
+				continue
+			}
+			transports[host+"|"+group] = &hostTransport{t, upstreamKey(c)}
+		}
+	}
+	add("", this.DefaultUpstream)
+	for k, v := range this.Rule {
+		add(k, v.Upstream)
+	}
+	this.Transports = transports
+}
+
+// 替换配置前调用：上游配置和证书文件都没变的沿用旧配置的Transport
+func (this *Config) reuseTransports(prev *Config) {
+	for k, t := range this.Transports {
+		if old, ok := prev.Transports[k]; ok && old.Key == t.Key {
+			this.Transports[k] = old
+		}
+	}
+}
+
+// 替换配置后调用：关闭旧配置中不再使用的Transport的空闲连接，正在进行的请求不受影响
+func (this *Config) closeTransports(next *Config) {
+	used := make(map[*hostTransport]bool, len(next.Transports))
+	for _, t := range next.Transports {
+		used[t] = true
+	}
+	for _, t := range this.Transports {
+		if !used[t] {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+func (this *Config) GetUpstream(host, group string) (ret *ConfigUpstream) {
+	if this.Rule != nil {
+		if v, ok := this.Rule[host]; ok && v.Upstream != nil {
+			if ret, ok = v.Upstream[group]; ok {
+				return
+			}
+		}
+	}
+	if this.DefaultUpstream != nil {
+		ret = this.DefaultUpstream[group]
+	}
+	return
+}
+
+func (this *ConfigUpstream) GetScheme() (ret string) {
+	if this != nil {
+		ret = this.Scheme
+	}
+	return
+}
+
+func (this *Config) GetUpstreamURL(host, group, addr string) (*url.URL, error) {
+	return parseUpstream(addr, this.GetUpstream(host, group).GetScheme())
+}
+
+// https上游通过ALPN协商HTTP/2，h2c上游直接使用HTTP/2
+func (this *Config) GetTransport(host, group, scheme string) http.RoundTripper {
+	if scheme == "h2c" {
+		return h2cTransport
+	}
+	transports := this.Transports
+	if t, ok := transports[host+"|"+group]; ok {
+		return t.Transport
+	}
+	if t, ok := transports["|"+group]; ok {
+		return t.Transport
+	}
+	return http.DefaultTransport
+}
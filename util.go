@@ -1,19 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"fmt"
-	"hash"
-	"io"
 	"math"
-	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
 func Exists(path string) bool {
@@ -27,6 +20,38 @@ func Exists(path string) bool {
 	return true
 }
 
+// 先写临时文件再rename，避免写到一半的文件被读到
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
+
+// 去掉host中的端口
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
 func AbEncode(secret_key_1, sk []byte) []byte {
 	ret := make([]byte, len(sk))
 	for k1, v1 := range sk {
@@ -136,73 +161,3 @@ func GetMacAddrs() (string, error) {
 	}
 	return "", err
 }
-
-type ZdUUID struct {
-	base_hash hash.Hash
-	buffer    bytes.Buffer
-	mutex     sync.Mutex
-	rand_part map[string]interface{} //动态随机因子
-	base_part string                 //固定随机因子
-}
-
-func NewUUID() *ZdUUID {
-	obj := &ZdUUID{
-		base_hash: md5.New(),
-		buffer:    bytes.Buffer{},
-		mutex:     sync.Mutex{},
-		rand_part: make(map[string]interface{}),
-	}
-
-	host, _ := os.Hostname()
-	mac, _ := GetMacAddrs()
-	obj.base_part = host + mac + GetLocalIP()
-	obj.rand_part["time"] = func() interface{} {
-		return time.Now().UnixNano()
-	}
-	obj.rand_part["rand"] = func() interface{} {
-		rand.Seed(time.Now().UnixNano())
-		return rand.Intn(1<<63 - 1)
-	}
-	return obj
-}
-
-func (this *ZdUUID) reset() {
-	this.base_part = ""
-	this.rand_part = make(map[string]interface{})
-}
-
-//可以从外部重新自定义随机因子
-func (this *ZdUUID) setConfig(base_part string, rand_part map[string]interface{}) {
-	this.reset()
-	this.base_part = base_part
-	this.rand_part = rand_part
-}
-
-//go tool pprof -http=:8000 http://localhost:10000/debug/pprof/heap
-func (this *ZdUUID) createUUID() string {
-	this.mutex.Lock()
-	this.buffer.Reset()
-	this.buffer.WriteString(this.base_part)
-	for _, v := range this.rand_part {
-		this.buffer.WriteString(fmt.Sprintf("%v", v.(func() interface{})()))
-	}
-	this.base_hash.Reset()
-	io.WriteString(this.base_hash, this.buffer.String())
-	hashstr := fmt.Sprintf("%X", this.base_hash.Sum(nil))
-	tmp := make([]string, 0, 7)
-	for i := 0; i < 4; i++ {
-		tmp = append(tmp, hashstr[i*8:i*8+8])
-	}
-	this.mutex.Unlock()
-	return strings.Join(tmp, "-")
-	// this.buffer.Reset()
-	// this.buffer.WriteString(hashstr[0:8])
-	// this.buffer.WriteByte('-')
-	// this.buffer.WriteString(hashstr[8:16])
-	// this.buffer.WriteByte('-')
-	// this.buffer.WriteString(hashstr[16:24])
-	// this.buffer.WriteByte('-')
-	// this.buffer.WriteString(hashstr[24:32])
-	// this.mutex.Unlock()
-	// return this.buffer.String()
-}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var anyType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// 配置校验错误，Offset为出错位置在文件中的字节偏移
+type ConfigError struct {
+	Path   string
+	Offset int64
+	Msg    string
+}
+
+// 按 文件:行:列: 路径: 错误 的格式输出
+func (this ConfigError) Format(fileName string, data []byte) string {
+	off := int(this.Offset)
+	if off > len(data) {
+		off = len(data)
+	}
+	line := bytes.Count(data[:off], []byte("\n")) + 1
+	col := off - bytes.LastIndexByte(data[:off], '\n')
+	return this.format(configPos{File: fileName, Line: line, Col: col})
+}
+
+func (this ConfigError) format(pos configPos) string {
+	if this.Path == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", pos.File, pos.Line, pos.Col, this.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", pos.File, pos.Line, pos.Col, this.Path, this.Msg)
+}
+
+type configChecker struct {
+	dec  *json.Decoder
+	pos  map[string]int64 //路径对应的key在文件中的位置
+	errs []ConfigError
+}
+
+// 严格校验配置：语法、未知字段、重复key、类型，以及上游地址、分组、密钥等
+func ValidateConfig(data []byte) []ConfigError {
+	this := &configChecker{
+		dec: json.NewDecoder(bytes.NewReader(data)),
+		pos: make(map[string]int64),
+	}
+	this.dec.UseNumber()
+	if err := this.value(reflect.TypeOf(Config{}), ""); err != nil {
+		var se *json.SyntaxError
+		off := this.dec.InputOffset()
+		if errors.As(err, &se) {
+			off = se.Offset
+		}
+		return append(this.errs, ConfigError{Offset: off, Msg: err.Error()})
+	}
+	if _, err := this.dec.Token(); err != io.EOF {
+		return append(this.errs, ConfigError{Offset: this.dec.InputOffset(), Msg: "unexpected data after config"})
+	}
+
+	c := NewConfig("")
+	var te *json.UnmarshalTypeError
+	if err := json.Unmarshal(data, c); err == nil || errors.As(err, &te) { //类型错误上面已经报告过
+		this.checkConfig(c)
+	}
+	sort.SliceStable(this.errs, func(i, j int) bool {
+		return this.errs[i].Offset < this.errs[j].Offset
+	})
+	return this.errs
+}
+
+// 校验内存中的配置，管理接口修改后在保存前调用，错误没有文件位置
+func CheckConfig(c *Config) error {
+	this := &configChecker{pos: make(map[string]int64)}
+	this.checkConfig(c)
+	if len(this.errs) == 0 {
+		return nil
+	}
+	msg := make([]string, 0, len(this.errs))
+	for _, v := range this.errs {
+		msg = append(msg, v.Path+": "+v.Msg)
+	}
+	sort.Strings(msg)
+	return errors.New(strings.Join(msg, "; "))
+}
+
+func (this *configChecker) addError(path, format string, v ...interface{}) {
+	this.errs = append(this.errs, ConfigError{
+		Path:   path,
+		Offset: this.pos[path],
+		Msg:    fmt.Sprintf(format, v...),
+	})
+}
+
+// 结构体中json字段名对应的类型
+func jsonFields(t reflect.Type) ([]string, map[string]reflect.Type) {
+	names := make([]string, 0, t.NumField())
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := jsonName(f)
+		if !ok {
+			continue
+		}
+		names = append(names, name)
+		fields[name] = f.Type
+	}
+	return names, fields
+}
+
+// 字段在json中的名字，不导出或json:"-"的返回false
+func jsonName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	name := f.Name
+	if tag := f.Tag.Get("json"); tag != "" {
+		if tag == "-" {
+			return "", false
+		}
+		if v, _, _ := strings.Cut(tag, ","); v != "" {
+			name = v
+		}
+	}
+	return name, true
+}
+
+func kindName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return t.Kind().String()
+}
+
+// 读取下一个值，按期望的类型检查
+func (this *configChecker) value(t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	tok, err := this.dec.Token()
+	if err != nil {
+		return err
+	}
+	if _, ok := this.pos[path]; !ok {
+		this.pos[path] = this.dec.InputOffset()
+	}
+	ok := t.Kind() == reflect.Interface
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			if !ok && t.Kind() != reflect.Struct && t.Kind() != reflect.Map {
+				this.addError(path, "expect %s, got object", kindName(t))
+				t = anyType
+			}
+			return this.object(t, path)
+		}
+		if !ok && t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			this.addError(path, "expect %s, got array", kindName(t))
+			t = anyType
+		}
+		return this.array(t, path)
+	case string:
+		if !ok && t.Kind() != reflect.String {
+			this.addError(path, "expect %s, got string %q", kindName(t), v)
+		}
+	case json.Number:
+		switch kindName(t) {
+		case "integer":
+			if _, err := v.Int64(); err != nil {
+				this.addError(path, "expect integer, got %s", v)
+			}
+		case "number":
+		default:
+			if !ok {
+				this.addError(path, "expect %s, got number %s", kindName(t), v)
+			}
+		}
+	case bool:
+		if !ok && t.Kind() != reflect.Bool {
+			this.addError(path, "expect %s, got boolean", kindName(t))
+		}
+	}
+	return nil
+}
+
+func (this *configChecker) object(t reflect.Type, path string) error {
+	var fields map[string]reflect.Type
+	if t.Kind() == reflect.Struct {
+		_, fields = jsonFields(t)
+	}
+	seen := make(map[string]bool)
+	for this.dec.More() {
+		tok, err := this.dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		off := this.dec.InputOffset()
+
+		sub, ft := fmt.Sprintf("%s[%q]", path, key), anyType
+		switch t.Kind() {
+		case reflect.Struct:
+			sub = strings.TrimPrefix(path+"."+key, ".")
+			var ok bool
+			if ft, ok = fields[key]; !ok {
+				for name, v := range fields { //encoding/json不区分大小写
+					if strings.EqualFold(name, key) {
+						ft, ok = v, true
+					}
+				}
+			}
+			if !ok {
+				this.pos[sub] = off
+				this.addError(sub, "unknown field")
+				ft = anyType
+			}
+		case reflect.Map:
+			ft = t.Elem()
+		}
+		if seen[key] {
+			this.errs = append(this.errs, ConfigError{Path: sub, Offset: off, Msg: "duplicate key"})
+		} else {
+			this.pos[sub] = off
+		}
+		seen[key] = true
+		if err := this.value(ft, sub); err != nil {
+			return err
+		}
+	}
+	_, err := this.dec.Token()
+	return err
+}
+
+func (this *configChecker) array(t reflect.Type, path string) error {
+	et := anyType
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		et = t.Elem()
+	}
+	for i := 0; this.dec.More(); i++ {
+		if err := this.value(et, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	_, err := this.dec.Token()
+	return err
+}
+
+// 检查上游地址格式
+func (this *configChecker) checkUpstreams(path string, addrs []string, scheme string) {
+	for i, addr := range addrs {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		u, err := parseUpstream(addr, scheme)
+		if err != nil {
+			this.addError(p, "invalid upstream: %v", err)
+			continue
+		}
+		switch u.Scheme {
+		case "http", "https", "h2c":
+		default:
+			this.addError(p, "unsupported upstream scheme %q", u.Scheme)
+		}
+		if strings.Contains(u.Host, ":") {
+			if _, port, err := net.SplitHostPort(u.Host); err != nil {
+				this.addError(p, "invalid upstream address: %v", err)
+			} else if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+				this.addError(p, "invalid upstream port %q", port)
+			}
+		}
+	}
+}
+
+func (this *configChecker) checkUpstreamConfig(path string, upstream map[string]*ConfigUpstream) {
+	for g, v := range upstream {
+		p := fmt.Sprintf("%s[%q]", path, g)
+		if g != groupA && g != groupB {
+			this.addError(p, "unknown group, expect groupA or groupB")
+		}
+		if v == nil {
+			continue
+		}
+		switch v.Scheme {
+		case "", "http", "https", "h2c":
+		default:
+			this.addError(p+".scheme", "unsupported upstream scheme %q", v.Scheme)
+		}
+		if (v.Cert == "") != (v.Key == "") {
+			this.addError(p, "cert and key must be configured together")
+		}
+	}
+}
+
+func (this *configChecker) checkConfig(c *Config) {
+	for name, v := range map[string]int64{"bufferSize": int64(c.Default.BufferSize), "pollInterval": c.Default.PollInterval} {
+		if c.Default.present[name] && v <= 0 {
+			this.addError("defaultOption."+name, "must be greater than 0")
+		}
+	}
+	this.checkUpstreamConfig("defaultUpstream", c.DefaultUpstream)
+
+	needDefaultB := false
+	for _, v := range c.Rule {
+		if v.GroupB == nil {
+			needDefaultB = true
+		}
+	}
+	for _, g := range []string{groupA, groupB} {
+		p := fmt.Sprintf("defaultServer[%q]", g)
+		addrs, ok := c.DefaultServer[g]
+		if ok && len(addrs) == 0 {
+			this.addError(p, "empty group")
+		} else if !ok && (g == groupA || needDefaultB) {
+			this.addError("defaultServer", "missing %s", g)
+		}
+		this.checkUpstreams(p, addrs, c.DefaultUpstream[g].GetScheme())
+	}
+	for i, v := range c.DefaultSecret {
+		if v == "" {
+			this.addError(fmt.Sprintf("defaultSecret[%d]", i), "empty secret")
+		}
+	}
+
+	lower := make(map[string]string)
+	for host, rule := range c.Rule {
+		p := fmt.Sprintf("rule[%q]", host)
+		if host == "" {
+			this.addError(p, "empty host")
+		}
+		if other, ok := lower[strings.ToLower(host)]; ok {
+			this.addError(p, "duplicate host, same as %q", other)
+		}
+		lower[strings.ToLower(host)] = host
+
+		this.checkUpstreamConfig(p+".upstream", rule.Upstream)
+		for g, addrs := range map[string][]string{groupA: rule.GroupA, groupB: rule.GroupB} {
+			if addrs != nil && len(addrs) == 0 {
+				this.addError(p+"."+g, "empty group")
+			}
+			this.checkUpstreams(p+"."+g, addrs, c.GetUpstream(host, g).GetScheme())
+		}
+
+		secrets := rule.Secret
+		if secrets == nil {
+			secrets = c.DefaultSecret
+		}
+		for i, v := range rule.Secret {
+			if v == "" {
+				this.addError(fmt.Sprintf("%s.secrets[%d]", p, i), "empty secret")
+			}
+		}
+		audience := false
+		for name, file := range map[string]string{"uidFile": rule.UidFile, "telphoneFile": rule.TelphoneFile, "cityFile": rule.CityFile} {
+			if file == "" {
+				continue
+			}
+			audience = true
+			if _, err := os.Stat(file); err != nil {
+				this.addError(p+"."+name, "%v", err)
+			}
+		}
+		for name, ranges := range map[string][]ConfigRange{"uidRanges": rule.UidRanges, "telphoneRanges": rule.TelphoneRanges, "cityRanges": rule.CityRanges} {
+			for i, r := range ranges {
+				rp := fmt.Sprintf("%s.%s[%d]", p, name, i)
+				if r.Min > r.Max {
+					this.addError(rp, "min %d is greater than max %d", r.Min, r.Max)
+				}
+				if r.Mod < 0 || (r.Mod > 0 && (r.Min < 0 || r.Max >= r.Mod)) {
+					this.addError(rp, "with mod %d, min and max must be in [0, %d)", r.Mod, r.Mod)
+				}
+			}
+			if len(ranges) > 0 {
+				audience = true
+			}
+		}
+		if _, err := parseSchedule(rule); err != nil {
+			this.addError(p, "%v", err)
+		}
+		if rule.Holdout < 0 || rule.Holdout >= 100 {
+			this.addError(p+".holdout", "must be in [0, 100)")
+		}
+		if h := rule.Headers; h != nil {
+			for name, ops := range map[string]*ConfigHeaderOps{"request": h.Request, "response": h.Response} {
+				for _, v := range ops.names() {
+					if !validHeaderName(v) {
+						this.addError(p+".headers."+name, "invalid header name %q", v)
+					}
+				}
+			}
+		}
+		for _, v := range checkLayers(rule.Layers) {
+			this.addError(p+".layers", "%s", v)
+		}
+		for i, v := range rule.ClientIPs {
+			if _, err := parsePrefixes([]string{v}); err != nil {
+				this.addError(fmt.Sprintf("%s.clientIPs[%d]", p, i), "%v", err)
+			}
+		}
+		if len(secrets) == 0 && (len(rule.Uid)+len(rule.Telphone)+len(rule.City) > 0 || audience) {
+			this.addError(p, "uids/telphones/citys need secrets to decode the data token")
+		}
+		if (rule.Cert == "") != (rule.Key == "") {
+			this.addError(p, "cert and key must be configured together")
+		}
+	}
+
+	if c.TLS != nil && c.TLS.Port > 0 {
+		hasCert := c.TLS.Cert != ""
+		for _, v := range c.Rule {
+			hasCert = hasCert || v.Cert != ""
+		}
+		if !hasCert {
+			this.addError("tls", "https enabled but no certificate configured")
+		}
+	}
+	for i, v := range c.TrustedProxies {
+		if _, err := parsePrefixes([]string{v}); err != nil {
+			this.addError(fmt.Sprintf("trustedProxies[%d]", i), "%v", err)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, v := range c.DecisionHeaders.names() {
+		if v == "" {
+			continue
+		}
+		if !validHeaderName(v) {
+			this.addError("decisionHeaders", "invalid header name %q", v)
+		}
+		if seen[http.CanonicalHeaderKey(v)] {
+			this.addError("decisionHeaders", "header %s is used more than once", v)
+		}
+		seen[http.CanonicalHeaderKey(v)] = true
+	}
+	if c.Events != nil {
+		for _, v := range checkEvents(c.Events) {
+			this.addError("events", "%s", v)
+		}
+	}
+	if t := c.Tracing; t != nil {
+		if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			this.addError("tracing.endpoint", "expect an http(s) url, like http://127.0.0.1:4318/v1/traces")
+		}
+		if t.SampleRate < 0 || t.SampleRate > 1 {
+			this.addError("tracing.sampleRate", "must be in [0, 1]")
+		}
+	}
+	switch c.ForwardedHeaders {
+	case "", forwardedX, forwardedStd, forwardedBoth, forwardedNone:
+	default:
+		this.addError("forwardedHeaders", "unknown value %q, expect x-forwarded, forwarded, both or none", c.ForwardedHeaders)
+	}
+	if c.Holdout < 0 || c.Holdout >= 100 {
+		this.addError("holdout", "must be in [0, 100)")
+	}
+	if a := c.Admin; a != nil {
+		if a.Token == "" && a.ClientCA == "" {
+			this.addError("admin", "token or clientCA is required")
+		}
+		if a.ClientCA != "" && (a.Cert == "" || a.Key == "") { //没有https时客户端证书不会被校验
+			this.addError("admin", "cert and key are required when clientCA is set")
+		} else if (a.Cert == "") != (a.Key == "") {
+			this.addError("admin", "cert and key must be set together")
+		}
+		for i, v := range a.AllowIPs { //和adminAllowIP的解析方式一致，写错的项不会匹配任何ip
+			p := fmt.Sprintf("admin.allowIPs[%d]", i)
+			if strings.Contains(v, "/") {
+				if _, _, err := net.ParseCIDR(v); err != nil {
+					this.addError(p, "%v", err)
+				}
+			} else if net.ParseIP(v) == nil {
+				this.addError(p, "invalid ip %q", v)
+			}
+		}
+	}
+}
+
+// 根据配置结构生成JSON Schema，供编辑器补全和校验
+func ConfigSchema() map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(Config{}))
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "http-abtest config"
+	return s
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		names, fields := jsonFields(t)
+		props := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			props[name] = typeSchema(fields[name])
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{"type": kindName(t)}
+}
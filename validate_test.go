@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 第1行是合法的defaultServer，之后每个参数一行
+func testConfig(lines ...string) string {
+	return "{\"defaultServer\": {\"groupA\": [\"127.0.0.1:1\"], \"groupB\": [\"127.0.0.1:2\"]},\n" + strings.Join(lines, ",\n") + "\n}\n"
+}
+
+func TestValidateConfig(t *testing.T) {
+	cases := []struct {
+		name, text string
+		want       []string //按 文件:行:列: 路径: 错误 输出，只比较开头；key的位置在key之后，数组元素在元素之后
+	}{
+		{"ok", testConfig(`"rule": {"a.com": {"versions": ["v1"]}}`), nil},
+		{"syntax", "{\"rule\": {\n  \"a.com\": {,}}}", []string{"c.json:2:14: invalid character ','"}},
+		{"trailing data", "{}\n{}", []string{"c.json:2:2: unexpected data after config"}},
+		{"unknown field", testConfig(`"rule": {"a.com": {"uid": [1]}}`), []string{`c.json:2:25: rule["a.com"].uid: unknown field`}},
+		{"duplicate key", testConfig(`"holdout": 1`, `"holdout": 2`), []string{"c.json:3:10: holdout: duplicate key"}},
+		{"type", testConfig(`"rule": {"a.com": {"versions": "v1"}}`), []string{`c.json:2:30: rule["a.com"].versions: expect array, got string "v1"`}},
+		{"integer", testConfig(`"rule": {"a.com": {"secrets": ["s"], "uids": [1.5]}}`), []string{`c.json:2:50: rule["a.com"].uids[0]: expect integer, got 1.5`}},
+		{"missing groupA", "{\"defaultServer\": {\n\"groupB\": [\"127.0.0.1:2\"]}}", []string{"c.json:1:17: defaultServer: missing groupA"}},
+		{"empty group", testConfig(`"rule": {"a.com": {"groupA": []}}`), []string{`c.json:2:28: rule["a.com"].groupA: empty group`}},
+		{"upstream", testConfig(`"rule": {"a.com": {"groupB": ["ftp://b"]}}`), []string{`c.json:2:40: rule["a.com"].groupB[0]: unsupported upstream scheme "ftp"`}},
+		{"upstream port", testConfig(`"rule": {"a.com": {"groupB": ["b:0"]}}`), []string{`c.json:2:36: rule["a.com"].groupB[0]: invalid upstream port "0"`}},
+		{"empty secret", testConfig(`"defaultSecret": [""]`), []string{"c.json:2:21: defaultSecret[0]: empty secret"}},
+		{"need secrets", testConfig(`"rule": {"a.com": {"uids": [1]}}`), []string{`c.json:2:17: rule["a.com"]: uids/telphones/citys need secrets`}},
+		{"audience file", testConfig(`"rule": {"a.com": {"secrets": ["s"], "uidFile": "/nonexistent"}}`), []string{`c.json:2:47: rule["a.com"].uidFile: stat /nonexistent`}},
+		{"range", testConfig(`"rule": {"a.com": {"secrets": ["s"], "uidRanges": [{"min": 5, "max": 1}]}}`), []string{`c.json:2:53: rule["a.com"].uidRanges[0]: min 5 is greater than max 1`}},
+		{"schedule", testConfig(`"rule": {"a.com": {"endAt": "x"}}`), []string{`c.json:2:17: rule["a.com"]: endAt: parsing time "x"`}},
+		{"rule holdout", testConfig(`"rule": {"a.com": {"holdout": 100}}`), []string{`c.json:2:29: rule["a.com"].holdout: must be in [0, 100)`}},
+		{"header name", testConfig(`"rule": {"a.com": {"headers": {"request": {"remove": ["a b"]}}}}`), []string{`c.json:2:41: rule["a.com"].headers.request: invalid header name "a b"`}},
+		{"layers", testConfig(`"rule": {"a.com": {"layers": {"l": {"experiments": [{"name": "e", "from": 0, "to": 1000}]}}}}`), []string{`c.json:2:28: rule["a.com"].layers: layer l: experiment e buckets`}},
+		{"client ip", testConfig(`"rule": {"a.com": {"clientIPs": ["x"]}}`), []string{`c.json:2:37: rule["a.com"].clientIPs[0]: ParseAddr("x")`}},
+		{"rule cert", testConfig(`"rule": {"a.com": {"cert": "a.pem"}}`), []string{`c.json:2:17: rule["a.com"]: cert and key must be configured together`}},
+		{"tls", testConfig(`"tls": {"port": 443}`), []string{"c.json:2:6: tls: https enabled but no certificate configured"}},
+		{"trusted proxies", testConfig(`"trustedProxies": ["10.0.0.0/33"]`), []string{"c.json:2:33: trustedProxies[0]: netip.ParsePrefix"}},
+		{"decision headers", testConfig(`"decisionHeaders": {"variant": "AB", "experiment": "ab"}`), []string{"c.json:2:18: decisionHeaders: header ab is used more than once"}},
+		{"events", testConfig(`"events": {"output": "kafka"}`), []string{`c.json:2:9: events: unknown output "kafka"`}},
+		{"track path", testConfig(`"events": {"output": "stdout", "trackPath": "t"}`), []string{`c.json:2:9: events: trackPath "t" must start with /`}},
+		{"tracing", testConfig(`"tracing": {"endpoint": "collector:4318", "sampleRate": 2}`), []string{"c.json:2:23: tracing.endpoint: expect an http(s) url", "c.json:2:55: tracing.sampleRate: must be in [0, 1]"}},
+		{"forwarded headers", testConfig(`"forwardedHeaders": "all"`), []string{`c.json:2:19: forwardedHeaders: unknown value "all"`}},
+		{"holdout", testConfig(`"holdout": -1`), []string{"c.json:2:10: holdout: must be in [0, 100)"}},
+		{"admin", testConfig(`"admin": {"port": 9000}`), []string{"c.json:2:8: admin: token or clientCA is required"}},
+		{"admin allowIPs", testConfig(`"admin": {"token": "t", "allowIPs": ["10.0.0.1", "10.0.0.0/8", "10.0.0.300", "10.0.0.0/40"]}`), []string{`c.json:2:76: admin.allowIPs[2]: invalid ip "10.0.0.300"`, `c.json:2:91: admin.allowIPs[3]: invalid CIDR address: 10.0.0.0/40`}},
+		{"option", testConfig(`"defaultOption": {"bufferSize": 0}`), []string{"c.json:2:31: defaultOption.bufferSize: must be greater than 0"}},
+	}
+	for _, c := range cases {
+		errs := ValidateConfig([]byte(c.text))
+		if len(errs) != len(c.want) {
+			t.Errorf("%s: got %d errors %+v, expect %d", c.name, len(errs), errs, len(c.want))
+			continue
+		}
+		for i, e := range errs {
+			if got := e.Format("c.json", []byte(c.text)); !strings.HasPrefix(got, c.want[i]) {
+				t.Errorf("%s: got %q, expect %q", c.name, got, c.want[i])
+			}
+		}
+	}
+}
+
+// yaml、toml及include的文件也要报告原文件的行列
+func TestValidateConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"c.yaml": "# comment\ndefaultServer:\n  groupA: [127.0.0.1:1]\n  groupB:\n    - 127.0.0.1:99999\ninclude: [r.toml, r.json]\nrule:\n  a.com:\n    endAt: x\n",
+		"r.toml": "[rule.\"b.com\"]\nsecrets = [\"s\"]\nholdout = 200\n\n[[rule.\"b.com\".uidRanges]]\nmin = 5\nmax = 1\n",
+		"r.json": "{\"rule\": {\n  \"c.com\": {\"bogus\": 1}}}\n",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFiles, err := readConfigFiles(filepath.Join(dir, "c.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, e := range ValidateConfig(configFiles.Data) {
+		got[strings.TrimPrefix(configFiles.Format(e), dir+string(filepath.Separator))] = true
+	}
+	for _, v := range []string{
+		`c.yaml:5:5: defaultServer["groupB"][0]: invalid upstream port "99999"`,
+		`c.yaml:8:3: rule["a.com"]: endAt: parsing time "x" as "2006-01-02 15:04:05": cannot parse "x" as "2006"`,
+		`r.toml:3:1: rule["b.com"].holdout: must be in [0, 100)`,
+		`r.toml:5:1: rule["b.com"].uidRanges[0]: min 5 is greater than max 1`,
+		`r.json:2:20: rule["c.com"].bogus: unknown field`,
+	} {
+		if !got[v] {
+			t.Errorf("missing %q in %v", v, got)
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("got %d errors: %v", len(got), got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	watchDebounce     = 500 * time.Millisecond //编辑器保存时会连续产生多个事件
+	watchPollInterval = 2 * time.Second
+)
+
+// 监听目录中文件的变化，linux下用inotify实现
+type dirWatcher interface {
+	Add(dir string) error
+}
+
+// 本地配置文件及include的文件
+type fileSource struct {
+	filePath string
+	lock     sync.RWMutex
+	files    *configFiles //最近一次读取的结果，决定要监听哪些文件
+	watcher  dirWatcher
+}
+
+func newFileSource(filePath string) *fileSource {
+	return &fileSource{filePath: filePath}
+}
+
+func (this *fileSource) String() string {
+	return this.filePath
+}
+
+func (this *fileSource) Load() (*configFiles, error) {
+	files, err := readConfigFiles(this.filePath)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	this.files = files
+	this.lock.Unlock()
+	if this.watcher != nil {
+		this.watchDirs() //include可能新增了目录
+	}
+	return files, nil
+}
+
+// 监听文件变化，inotify不可用时轮询
+func (this *fileSource) Watch(changed func()) error {
+	if this.files == nil {
+		if _, err := this.Load(); err != nil {
+			return err
+		}
+	}
+	notify := func(fileName string) {
+		if this.match(fileName) {
+			changed()
+		}
+	}
+	watcher, err := newDirWatcher(notify)
+	if err != nil {
+		mylogger.Println("config watcher: inotify unavailable, polling instead:", err)
+		go this.poll(notify)
+	} else {
+		this.watcher = watcher
+		this.watchDirs()
+	}
+	log.Println("watching config files:", strings.Join(this.files.Files, ","))
+	return nil
+}
+
+// 需要监听的目录：主文件所在目录及include的glob所在目录
+func (this *fileSource) watchDirs() {
+	this.lock.RLock()
+	dirs := map[string]bool{filepath.Dir(this.filePath): true}
+	for _, v := range this.files.Include {
+		dirs[filepath.Dir(v)] = true
+	}
+	this.lock.RUnlock()
+	for dir := range dirs {
+		if err := this.watcher.Add(dir); err != nil {
+			mylogger.Println("config watcher:", dir, err)
+		}
+	}
+}
+
+// 是否是配置文件、已include的文件，或者匹配include的新文件
+func (this *fileSource) match(fileName string) bool {
+	if fileName == filepath.Clean(this.filePath) {
+		return true
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, v := range this.files.Files {
+		if fileName == v {
+			return true
+		}
+	}
+	for _, v := range this.files.Include {
+		if ok, _ := filepath.Match(v, fileName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 轮询文件的大小和修改时间
+func (this *fileSource) poll(notify func(fileName string)) {
+	last := this.stat()
+	for {
+		time.Sleep(watchPollInterval)
+		current := this.stat()
+		for k, v := range current {
+			if last[k] != v {
+				notify(k)
+			}
+		}
+		for k := range last {
+			if _, ok := current[k]; !ok {
+				notify(k)
+			}
+		}
+		last = current
+	}
+}
+
+func (this *fileSource) stat() map[string]string {
+	this.lock.RLock()
+	files := append([]string{filepath.Clean(this.filePath)}, this.files.Files...)
+	for _, v := range this.files.Include {
+		matches, _ := filepath.Glob(v)
+		files = append(files, matches...)
+	}
+	this.lock.RUnlock()
+	ret := make(map[string]string, len(files))
+	for _, v := range files {
+		if info, err := os.Stat(v); err == nil {
+			ret[v] = fmt.Sprintf("%v|%d", info.ModTime(), info.Size())
+		}
+	}
+	return ret
+}
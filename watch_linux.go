@@ -0,0 +1,70 @@
+//go:build linux
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+type inotifyWatcher struct {
+	fd   int
+	lock sync.Mutex
+	dirs map[int]string //watch描述符 -> 目录
+}
+
+// 监听目录而不是文件：编辑器和原子写入都是替换文件，文件本身的watch会失效
+func newDirWatcher(notify func(fileName string)) (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	this := &inotifyWatcher{fd: fd, dirs: make(map[int]string)}
+	go this.run(notify)
+	return this, nil
+}
+
+func (this *inotifyWatcher) Add(dir string) error {
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	wd, err := syscall.InotifyAddWatch(this.fd, dir, mask)
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	this.dirs[wd] = dir
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *inotifyWatcher) run(notify func(fileName string)) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(this.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			mylogger.Println("config watcher: read inotify error:", err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(event.Len)]
+			off += syscall.SizeofInotifyEvent + int(event.Len)
+			for i, c := range name { //名字以\0补齐
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			this.lock.Lock()
+			dir, ok := this.dirs[int(event.Wd)]
+			this.lock.Unlock()
+			if ok && len(name) > 0 {
+				notify(filepath.Join(dir, string(name)))
+			}
+		}
+	}
+}
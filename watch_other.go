@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newDirWatcher(notify func(fileName string)) (dirWatcher, error) {
+	return nil, errors.New("inotify is only available on linux")
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 只支持配置文件用到的yaml子集：块状map和列表、单行的[...]和{...}、引号字符串、注释，不支持锚点和多行字符串
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+	keys  map[string]configPos //key和列表元素所在的行列，单行的[..]、{..}里面的只记到所在的key
+}
+
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	ret, _, err := parseYAMLPositions(data)
+	return ret, err
+}
+
+func parseYAMLPositions(data []byte) (map[string]interface{}, map[string]configPos, error) {
+	p := &yamlParser{keys: make(map[string]configPos)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || text == "---" || text == "..." {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(line) - len(text), text: text})
+	}
+	if len(p.lines) == 0 {
+		return map[string]interface{}{}, p.keys, nil
+	}
+	v, err := p.block(p.lines[0].indent, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, nil, fmt.Errorf("line %d: bad indentation", p.lines[p.pos].num)
+	}
+	ret, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("line %d: top level must be a mapping", p.lines[0].num)
+	}
+	return ret, p.keys, nil
+}
+
+// 去掉引号外的注释
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (this *yamlParser) block(indent int, path string) (interface{}, error) {
+	if isYAMLSeqItem(this.lines[this.pos].text) {
+		return this.sequence(indent, path)
+	}
+	return this.mapping(indent, path)
+}
+
+func (this *yamlParser) mapping(indent int, path string) (interface{}, error) {
+	ret := make(map[string]interface{})
+	for this.pos < len(this.lines) {
+		line := this.lines[this.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent || isYAMLSeqItem(line.text) {
+			return nil, fmt.Errorf("line %d: bad indentation", line.num)
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expect key: value", line.num)
+		}
+		k, err := yamlScalarKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line.num, err)
+		}
+		if _, ok := ret[k]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.num, k)
+		}
+		sub := configKey(path, k)
+		this.keys[sub] = configPos{Line: line.num, Col: line.indent + 1}
+		this.pos++
+
+		if rest != "" {
+			if ret[k], err = yamlInline(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.num, err)
+			}
+			continue
+		}
+		ret[k] = nil
+		if this.pos < len(this.lines) {
+			next := this.lines[this.pos]
+			if next.indent > indent || (next.indent == indent && isYAMLSeqItem(next.text)) {
+				if ret[k], err = this.block(next.indent, sub); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (this *yamlParser) sequence(indent int, path string) (interface{}, error) {
+	ret := make([]interface{}, 0)
+	for this.pos < len(this.lines) {
+		line := this.lines[this.pos]
+		if line.indent < indent || (line.indent == indent && !isYAMLSeqItem(line.text)) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: bad indentation", line.num)
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		sub := configKey(path, strconv.Itoa(len(ret)))
+		this.keys[sub] = configPos{Line: line.num, Col: line.indent + 1}
+		if rest == "" {
+			this.pos++
+			if this.pos < len(this.lines) && this.lines[this.pos].indent > indent {
+				v, err := this.block(this.lines[this.pos].indent, sub)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, v)
+			} else {
+				ret = append(ret, nil)
+			}
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok && rest[0] != '[' && rest[0] != '{' { // - key: value 开始的map
+			offset := line.indent + len(line.text) - len(rest)
+			this.lines[this.pos] = yamlLine{num: line.num, indent: offset, text: rest}
+			v, err := this.mapping(offset, sub)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+			continue
+		}
+		v, err := yamlInline(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line.num, err)
+		}
+		ret = append(ret, v)
+		this.pos++
+	}
+	return ret, nil
+}
+
+// 按引号外第一个 ": " 或行尾的 ":" 分割key和value
+func splitYAMLKey(text string) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func yamlScalarKey(key string) (string, error) {
+	v, err := yamlInline(key)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return key, nil
+}
+
+// 单行的值：[..]、{..}、引号字符串或普通标量
+func yamlInline(text string) (interface{}, error) {
+	s := &flowScanner{text: text}
+	v, err := s.value()
+	if err != nil {
+		return nil, err
+	}
+	s.skipSpace()
+	if s.pos < len(s.text) {
+		return nil, fmt.Errorf("unexpected %q", s.text[s.pos:])
+	}
+	return v, nil
+}
+
+type flowScanner struct {
+	text  string
+	pos   int
+	depth int //[..]、{..}的嵌套层数
+}
+
+func (this *flowScanner) skipSpace() {
+	for this.pos < len(this.text) && (this.text[this.pos] == ' ' || this.text[this.pos] == '\t') {
+		this.pos++
+	}
+}
+
+func (this *flowScanner) value() (interface{}, error) {
+	this.skipSpace()
+	if this.pos >= len(this.text) {
+		return nil, nil
+	}
+	switch this.text[this.pos] {
+	case '[':
+		this.pos++
+		this.depth++
+		ret := make([]interface{}, 0)
+		for {
+			this.skipSpace()
+			if this.pos < len(this.text) && this.text[this.pos] == ']' {
+				this.pos++
+				this.depth--
+				return ret, nil
+			}
+			v, err := this.value()
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+			if err := this.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		this.pos++
+		this.depth++
+		ret := make(map[string]interface{})
+		for {
+			this.skipSpace()
+			if this.pos < len(this.text) && this.text[this.pos] == '}' {
+				this.pos++
+				this.depth--
+				return ret, nil
+			}
+			k, err := this.value()
+			if err != nil {
+				return nil, err
+			}
+			this.skipSpace()
+			if this.pos >= len(this.text) || this.text[this.pos] != ':' {
+				return nil, fmt.Errorf("expect ':' in flow mapping")
+			}
+			this.pos++
+			v, err := this.value()
+			if err != nil {
+				return nil, err
+			}
+			ret[fmt.Sprint(k)] = v
+			if err := this.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"':
+		end := this.pos + 1
+		for ; end < len(this.text) && this.text[end] != '"'; end++ {
+			if this.text[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(this.text) {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		v, err := strconv.Unquote(this.text[this.pos : end+1])
+		this.pos = end + 1
+		return v, err
+	case '\'':
+		var b strings.Builder
+		for i := this.pos + 1; i < len(this.text); i++ {
+			if this.text[i] == '\'' {
+				if i+1 < len(this.text) && this.text[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				this.pos = i + 1
+				return b.String(), nil
+			}
+			b.WriteByte(this.text[i])
+		}
+		return nil, fmt.Errorf("unterminated string")
+	case '|', '>':
+		return nil, fmt.Errorf("multi-line strings are not supported")
+	case '&', '*', '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	}
+
+	start := this.pos
+	for ; this.pos < len(this.text) && this.depth > 0; this.pos++ {
+		c := this.text[this.pos]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if c == ':' && (this.pos+1 == len(this.text) || this.text[this.pos+1] == ' ') {
+			break
+		}
+	}
+	if this.depth == 0 {
+		this.pos = len(this.text)
+	}
+	return yamlPlain(strings.TrimSpace(this.text[start:this.pos])), nil
+}
+
+func (this *flowScanner) separator(end byte) error {
+	this.skipSpace()
+	if this.pos >= len(this.text) {
+		return fmt.Errorf("expect ',' or '%c'", end)
+	}
+	if this.text[this.pos] == ',' {
+		this.pos++
+		return nil
+	}
+	if this.text[this.pos] != end {
+		return fmt.Errorf("expect ',' or '%c'", end)
+	}
+	return nil
+}
+
+func yamlPlain(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && strings.ContainsAny(s, "0123456789") {
+		return f
+	}
+	return s
+}
+
+// 输出为块状yaml，字符串统一用双引号
+func encodeYAML(v map[string]interface{}) []byte {
+	var b strings.Builder
+	writeYAMLMap(&b, v, 0)
+	return []byte(b.String())
+}
+
+func yamlKey(k string) string {
+	if k != "" && strings.Trim(k, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") == "" {
+		return k
+	}
+	return strconv.Quote(k)
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = yamlScalar(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}: //块结构中放不下的map，如列表中的列表里的map，用{k: v}
+		keys := sortedKeys(v)
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			items[i] = yamlKey(k) + ": " + yamlScalar(v[k])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+func isYAMLBlock(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok && len(m) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeYAMLMap(b *strings.Builder, m map[string]interface{}, indent int) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pad := strings.Repeat(" ", indent)
+	for _, k := range keys {
+		v := m[k]
+		if !isYAMLBlock(v) {
+			fmt.Fprintf(b, "%s%s: %s\n", pad, yamlKey(k), yamlScalar(v))
+			continue
+		}
+		fmt.Fprintf(b, "%s%s:\n", pad, yamlKey(k))
+		switch v := v.(type) {
+		case map[string]interface{}:
+			writeYAMLMap(b, v, indent+2)
+		case []interface{}:
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); ok && len(m) > 0 {
+					var sub strings.Builder
+					writeYAMLMap(&sub, m, indent+4)
+					fmt.Fprintf(b, "%s  - %s", pad, strings.TrimLeft(sub.String(), " "))
+				} else {
+					fmt.Fprintf(b, "%s  - %s\n", pad, yamlScalar(item))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		v    map[string]interface{}
+	}{
+		{"scalars", map[string]interface{}{"s": "a: b # c", "i": int64(-3), "f": 1.5, "b": true, "n": nil, "empty": ""}},
+		{"quoted key", map[string]interface{}{"a.b": "x", "中文": "y", "": "z"}},
+		{"nested map", map[string]interface{}{"rule": map[string]interface{}{"a.com": map[string]interface{}{"groupA": "http://a", "percent": int64(50)}}}},
+		{"list of maps", map[string]interface{}{"list": []interface{}{map[string]interface{}{"a": int64(1), "b": []interface{}{"x", "y"}}, "s"}}},
+		{"empty", map[string]interface{}{"m": map[string]interface{}{}, "l": []interface{}{}}},
+		{"map in flow list", map[string]interface{}{"l": []interface{}{[]interface{}{map[string]interface{}{"k": "v", "n": int64(2)}, map[string]interface{}{}}}}},
+		{"nested flow map", map[string]interface{}{"l": []interface{}{[]interface{}{map[string]interface{}{"m": map[string]interface{}{"a b": []interface{}{int64(1), "2"}}}}}}},
+	}
+	for _, c := range cases {
+		data := encodeYAML(c.v)
+		got, err := parseYAML(data)
+		if err != nil {
+			t.Errorf("%s: parse %q: %v", c.name, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.v) {
+			t.Errorf("%s: round trip %q\ngot  %#v\nwant %#v", c.name, data, got, c.v)
+		}
+	}
+}
+
+func TestYAMLParseError(t *testing.T) {
+	cases := []struct {
+		name, text, err string
+	}{
+		{"unclosed list", "a: [1, 2\n", ""},
+		{"unclosed map", "a: [{k: v]\n", ""},
+		{"bad indent", "a:\n  b: 1\n c: 2\n", ""},
+	}
+	for _, c := range cases {
+		_, err := parseYAML([]byte(c.text))
+		if err == nil {
+			t.Errorf("%s: expect error for %q", c.name, c.text)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %q, expect %q", c.name, err, c.err)
+		}
+	}
+}